@@ -2,15 +2,12 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 
 	"github.com/peter-howell/gosha256/sha256"
@@ -22,55 +19,37 @@ import (
 
 
 func handler(w *response.Writer, req *request.Request) {
-	target := req.RequestLine.RequestTarget
-	if strings.HasPrefix(target, "/httpbin/") {
-		handleProxy(w, req)
-		return
-	}
-	var body = ""
-	code := response.StatusOK
-
-	switch target {
-	case "/yourproblem":
-		handle400(w, req)
-		return
-	case "/myproblem":
-		handle500(w, req)
-		return
-	case "/video":
-		handleVideo(w, req)
-		return
-	default:
-		body = "<html>\n" +
-			"  <head>\n" +
-			"    <title>200 OK</title>\n" +
-			"  </head>\n" +
-			"  <body>\n" +
-			"    <h1>Success!</h1>\n" +
-			"    <p>Your request was an absolute banger.</p>\n" +
-			"  </body>\n" +
-			"</html>\n"
-	}
-	err := w.WriteStatusLine(code)
+	body := "<html>\n" +
+		"  <head>\n" +
+		"    <title>200 OK</title>\n" +
+		"  </head>\n" +
+		"  <body>\n" +
+		"    <h1>Success!</h1>\n" +
+		"    <p>Your request was an absolute banger.</p>\n" +
+		"  </body>\n" +
+		"</html>\n"
+	err := w.WriteStatusLine(response.StatusOK)
 	if err != nil {
 		fmt.Printf("Got an error\n%v\n", err)
 	}
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
-	w.WriteBody([]byte(body))
+	w.Write([]byte(body))
 }
 
-func handleProxy(w *response.Writer, req *request.Request) {
-	url := fmt.Sprintf("https://httpbin.org/%s", strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/"))
+func handleProxy(w *response.Writer, req *request.Request) error {
+	url := fmt.Sprintf("https://httpbin.org/%s", req.PathValue("path"))
+	if req.URL.RawQuery != "" {
+		url += "?" + req.URL.RawQuery
+	}
 
 	resp, err := http.Get(url)
 	if err != nil {
-		fmt.Printf("got an error, %v\n", err)
-		handle500(w, req)
-		return
+		return fmt.Errorf("proxying to %s: %w", url, err)
 	}
-	
+	defer resp.Body.Close()
+
 	w.WriteStatusLine(response.StatusOK)
 
 	h := headers.NewHeaders()
@@ -81,50 +60,17 @@ func handleProxy(w *response.Writer, req *request.Request) {
 
 	h.Set("Content-Type", contentType)
 	h.Set("Transfer-Encoding", "chunked")
-	h.Set("Connection", "close")
-	h.Set("Trailers", "X-Content-SHA256")
-	h.Set("Trailers", "X-Content-Length")
+	h.Add("Trailer", "X-Content-SHA256")
+	h.Add("Trailer", "X-Content-Length")
 	w.WriteHeaders(h)
 
-	bodyLen := 0
-	currentChunkSize := 0
-	const maxChunkSize = 1024
-	currentChunkBuf := make([]byte, maxChunkSize)
-	totalBodyBuf := make([]byte, 2048)
 	hasher := sha256.NewHasher()
-
-	for {
-		currentChunkSize, err = resp.Body.Read(currentChunkBuf)
-		fmt.Printf("Read %d bytes of data\n", currentChunkSize)
-
-		if err != nil && !errors.Is(err, io.EOF) {
-			fmt.Printf("Got an error reading the body, %v\n", err)
-			break
-		}
-
-		if currentChunkSize < 1 {
-			break
-		}
-		hasher.Write(currentChunkBuf[:currentChunkSize])
-
-		_, err = w.WriteChunkedBody(currentChunkBuf[:currentChunkSize])
-
-		if err != nil {
-			fmt.Printf("Got an error writing chunked body %v\n", err)
-			break
-		}
-
-		if currentCapacity := len(totalBodyBuf); currentCapacity <= bodyLen + currentChunkSize {
-			neededSize := int(math.Pow(2, math.Ceil(math.Log2(float64(currentCapacity + currentChunkSize)))))
-			tem := make([]byte, neededSize)
-			copy(tem, totalBodyBuf)
-			copy(tem[bodyLen:], currentChunkBuf[:currentChunkSize])
-			totalBodyBuf = tem
-		} else {
-			copy(totalBodyBuf[bodyLen:], currentChunkBuf[:currentChunkSize])
-		}
-		bodyLen += currentChunkSize
-
+	bodyLen, err := io.Copy(w, io.TeeReader(resp.Body, writerFunc(func(p []byte) (int, error) {
+		hasher.Write(p)
+		return len(p), nil
+	})))
+	if err != nil {
+		fmt.Printf("Got an error copying the body, %v\n", err)
 	}
 
 	_, err = w.WriteChunkedBodyDone()
@@ -139,77 +85,35 @@ func handleProxy(w *response.Writer, req *request.Request) {
 	trailers.Set("X-Content-SHA256", hashStr)
 	trailers.Set("X-Content-Length", fmt.Sprintf("%d", bodyLen))
 
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		fmt.Printf("got an error when writing trailers: %v\n", err)
-	}
-	
+	return w.WriteTrailers(trailers)
 }
 
-func handleVideo(w *response.Writer, req *request.Request) {
-	
-	
-	w.WriteStatusLine(response.StatusOK)
-	h := headers.NewHeaders()
-	h.Set("Content-Type", "video/mp4")
-	h.Set("Transfer-Encoding", "chunked")
-	h.Set("Connection", "close")
-	h.Set("Trailers", "X-Content-SHA256")
-	h.Set("Trailers", "X-Content-Length")
-	w.WriteHeaders(h)
-
+func handleVideo(w *response.Writer, req *request.Request) error {
 	fname := "assets/vim.mp4"
 
 	file, err := os.Open(fname)
 
 	if err != nil {
-		handle500(w, req)
-		return
+		return err
 	}
 
 	defer file.Close()
 
-	hasher := sha256.NewHasher()
-	bodyLen := 0
-	currentChunkSize := 0
-	const maxChunkSize = 1024
-	currentChunkBuf := make([]byte, maxChunkSize)
-	totalBodyBuf := make([]byte, 2048)
-
-	for {
-		currentChunkSize, err = file.Read(currentChunkBuf)
-		fmt.Printf("Read %d bytes of data\n", currentChunkSize)
-
-		if err != nil && !errors.Is(err, io.EOF) {
-			fmt.Printf("Got an error reading the body, %v\n", err)
-			break
-		}
-
-		if currentChunkSize < 1 {
-			fmt.Printf("Got chunk size %d, and breaking the loop\n", currentChunkSize)
-			break
-		}
-
-		hasher.Write(currentChunkBuf[:currentChunkSize])
-
-		_, err = w.WriteChunkedBody(currentChunkBuf[:currentChunkSize])
-
-		if err != nil {
-			fmt.Printf("Got an error writing chunked body %v\n", err)
-			break
-		}
-
-		if currentCapacity := len(totalBodyBuf); currentCapacity <= bodyLen + currentChunkSize {
-			neededSize := int(math.Pow(2, math.Ceil(math.Log2(float64(currentCapacity + currentChunkSize)))))
-			tem := make([]byte, neededSize)
-			copy(tem, totalBodyBuf)
-			copy(tem[bodyLen:], currentChunkBuf[:currentChunkSize])
-			totalBodyBuf = tem
-		} else {
-			copy(totalBodyBuf[bodyLen:], currentChunkBuf[:currentChunkSize])
-		}
-		bodyLen += currentChunkSize
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "video/mp4")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Add("Trailer", "X-Content-SHA256")
+	h.Add("Trailer", "X-Content-Length")
+	w.WriteHeaders(h)
 
+	hasher := sha256.NewHasher()
+	bodyLen, err := io.Copy(w, io.TeeReader(file, writerFunc(func(p []byte) (int, error) {
+		hasher.Write(p)
+		return len(p), nil
+	})))
+	if err != nil {
+		fmt.Printf("Got an error copying the body, %v\n", err)
 	}
 
 	_, err = w.WriteChunkedBodyDone()
@@ -224,64 +128,41 @@ func handleVideo(w *response.Writer, req *request.Request) {
 	trailers.Set("X-Content-SHA256", hashStr)
 	trailers.Set("X-Content-Length", fmt.Sprintf("%d", bodyLen))
 
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		fmt.Printf("got an error when writing trailers: %v\n", err)
-	}
-	
+	return w.WriteTrailers(trailers)
 }
 
-func handle500(w *response.Writer, _ *request.Request) {
+type writerFunc func(p []byte) (int, error)
 
-	code := response.StatusInternalServerError
-	body := "<html>\n" +
-		"  <head>\n" +
-		"    <title>500 Internal Server Error</title>\n" +
-		"  </head>\n" +
-		"  <body>\n" +
-		"    <h1>Internal Server Error</h1>\n" +
-		"    <p>Okay, you know what? This one is on me.</p>\n" +
-		"  </body>\n" +
-		"</html>\n"
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
 
-	err := w.WriteStatusLine(code)
-	if err != nil {
-		fmt.Printf("Got an error\n%v\n", err)
+func handle500(_ *response.Writer, _ *request.Request) error {
+	return &server.HandlerError{
+		StatusCode: response.StatusInternalServerError,
+		Msg: "Okay, you know what? This one is on me.",
 	}
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
-	w.WriteHeaders(h)
-	w.WriteBody([]byte(body))
 }
 
-func handle400(w *response.Writer, _ *request.Request) {
-
-	code := response.StatusBadRequest
-	body := "<html>\n" +
-		"  <head>\n" +
-		"    <title>400 Bad Request</title>\n" +
-		"  </head>\n" +
-		"  <body>\n" +
-		"    <h1>Bad Request</h1>\n" +
-		"    <p>Your request honestly kinda sucked.</p>\n" +
-		"  </body>\n" +
-		"</html>\n"
-
-	err := w.WriteStatusLine(code)
-	if err != nil {
-		fmt.Printf("Got an error\n%v\n", err)
+func handle400(_ *response.Writer, _ *request.Request) error {
+	return &server.HandlerError{
+		StatusCode: response.StatusBadRequest,
+		Msg: "Your request honestly kinda sucked.",
 	}
-	h := response.GetDefaultHeaders(len(body))
-	h.Replace("Content-Type", "text/html")
-	w.WriteHeaders(h)
-	w.WriteBody([]byte(body))
 }
 
-
 const port = 42069
 
 func main() {
-	server, err := server.Serve(port, handler)
+	router := server.NewRouter()
+	router.Use(server.Logger(nil))
+	router.Handle("/yourproblem", server.HandleError(handle400))
+	router.Handle("/myproblem", server.HandleError(handle500))
+	router.Handle("/video", server.HandleError(handleVideo))
+	router.Handle("/httpbin/{path...}", server.HandleError(handleProxy))
+	router.Handle("/{path...}", handler)
+
+	server, err := server.Serve(port, router.Serve)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -0,0 +1,167 @@
+// Package cookie parses Cookie request headers and builds Set-Cookie
+// response headers (RFC 6265)
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+)
+
+var ErrNoCookie = errors.New("named cookie not present")
+
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out and lets the browser decide
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge is the lifetime in seconds. Zero leaves the attribute out, a
+	// negative value tells the browser to delete the cookie now.
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+}
+
+// Parse splits the value of a Cookie request header into its name=value
+// pairs. Pairs that aren't valid are skipped.
+func Parse(header string) []*Cookie {
+	cookies := []*Cookie{}
+	// pairs are separated by "; ", and several Cookie headers end up joined
+	// with ", " by Headers.Get. Neither can appear in a valid name or value.
+	pairs := strings.FieldsFunc(header, func(r rune) bool { return r == ';' || r == ',' })
+	for _, pair := range pairs {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !validName(name) {
+			continue
+		}
+		val, ok = parseValue(val)
+		if !ok {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: val})
+	}
+	return cookies
+}
+
+// Valid reports the first problem that would make c an invalid Set-Cookie
+func (c *Cookie) Valid() error {
+	if !validName(c.Name) {
+		return fmt.Errorf("invalid cookie name %q", c.Name)
+	}
+	for i := 0; i < len(c.Value); i++ {
+		if !validValueByte(c.Value[i]) {
+			return fmt.Errorf("invalid byte %q in value of cookie %s", c.Value[i], c.Name)
+		}
+	}
+	if !validAttr(c.Path) {
+		return fmt.Errorf("invalid path %q in cookie %s", c.Path, c.Name)
+	}
+	if !validAttr(c.Domain) || strings.ContainsAny(c.Domain, " \t") {
+		return fmt.Errorf("invalid domain %q in cookie %s", c.Domain, c.Name)
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return fmt.Errorf("cookie %s has SameSite=None without Secure", c.Name)
+	}
+	return nil
+}
+
+// String returns c as the value of a Set-Cookie header. It doesn't check
+// that c is valid, see Valid.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	if strings.ContainsAny(c.Value, " ,") {
+		b.WriteString(`"` + c.Value + `"`)
+	} else {
+		b.WriteString(c.Value)
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(headers.TimeFormat))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	return b.String()
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue strips optional quotes and checks the value is cookie-octets
+func parseValue(val string) (string, bool) {
+	if len(val) > 1 && val[0] == '"' && val[len(val)-1] == '"' {
+		val = val[1 : len(val)-1]
+	}
+	for i := 0; i < len(val); i++ {
+		if !validValueByte(val[i]) || val[i] == ' ' || val[i] == ',' {
+			return "", false
+		}
+	}
+	return val, true
+}
+
+// validValueByte allows what RFC 6265 cookie-octet allows, plus space and
+// comma, which String quotes
+func validValueByte(c byte) bool {
+	return c >= 0x20 && c < 0x7f && c != '"' && c != ';' && c != '\\'
+}
+
+func validAttr(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] >= 0x7f || s[i] == ';' {
+			return false
+		}
+	}
+	return true
+}
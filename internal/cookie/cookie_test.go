@@ -0,0 +1,60 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Standard Cookie header
+	cookies := Parse("session=abc123; theme=dark; quoted=\"v1\"")
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "v1", cookies[2].Value)
+
+	// Test: Two Cookie headers joined by headers.Set
+	cookies = Parse("a=1; b=2, c=3")
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "c", cookies[2].Name)
+
+	// Test: Invalid pairs are skipped
+	cookies = Parse("novalue; bad name=1; ok=yes; =empty")
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "ok", cookies[0].Name)
+}
+
+func TestString(t *testing.T) {
+	c := &Cookie{
+		Name:     "session",
+		Value:    "abc123",
+		Path:     "/",
+		Domain:   ".example.com",
+		Expires:  time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:   3600,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: SameSiteLax,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=Lax", c.String())
+
+	c = &Cookie{Name: "gone", MaxAge: -1}
+	assert.Equal(t, "gone=; Max-Age=0", c.String())
+
+	c = &Cookie{Name: "spaced", Value: "a b"}
+	assert.Equal(t, `spaced="a b"`, c.String())
+}
+
+func TestValid(t *testing.T) {
+	assert.Error(t, (&Cookie{Name: "bad name", Value: "x"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Value: "a;b"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Value: "line\r\nSet-Cookie: evil=1"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Path: "/;Secure"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", SameSite: SameSiteNone}).Valid())
+	assert.NoError(t, (&Cookie{Name: "x", SameSite: SameSiteNone, Secure: true}).Valid())
+}
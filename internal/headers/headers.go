@@ -3,58 +3,264 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"slices"
 	"strings"
 )
 
-type Headers map[string]string
+var (
+	ErrMissingColon     = errors.New("field line has no colon")
+	ErrMissingName      = errors.New("field line has no name")
+	ErrSpaceBeforeColon = errors.New("whitespace between field name and colon")
+	ErrInvalidName      = errors.New("invalid field name")
+	ErrInvalidValue     = errors.New("invalid field value")
+	ErrObsFold          = errors.New("obsolete line folding")
+)
+
+// TimeFormat is the IMF-fixdate format used for dates in field values, such
+// as "Sun, 06 Nov 1994 08:49:37 GMT". Times must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Headers is an ordered list of fields. Names keep the casing they were
+// added or parsed with, lookups ignore case, and a name can appear more than
+// once.
+type Headers struct {
+	fields []field
+	// lenient accepts obsolete line folding when parsing
+	lenient bool
+}
+
+type field struct {
+	name  string
+	value string
+}
 
-func (h Headers) String() string {
-	if len(h) == 0 {
+func (h *Headers) String() string {
+	if h.Len() == 0 {
 		return ""
 	}
 	s := "Headers:"
-	for key, val := range h {
-		s += fmt.Sprintf("\n- %s: %s", key, val)
+	for _, f := range h.fields {
+		s += fmt.Sprintf("\n- %s: %s", f.name, f.value)
 	}
 	return s
 }
 
-func (h Headers) Write(w io.Writer) error {
-	if len(h) == 0 {
+func (h *Headers) Write(w io.Writer) error {
+	if h.Len() == 0 {
 		return nil
 	}
-	for key, val := range h {
-		_, err := fmt.Fprintf(w, "%s: %s\r\n", key, val)
+	err := h.WriteFields(w)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\r\n")
+
+	return err
+}
+
+// WriteFields writes the field lines in order without the empty line that
+// ends the section, so more lines can follow. Nothing is written if any name
+// or value is invalid, so a value carrying a CRLF can't inject extra lines.
+func (h *Headers) WriteFields(w io.Writer) error {
+	if err := h.Valid(); err != nil {
+		return err
+	}
+	for _, f := range h.fields {
+		_, err := fmt.Fprintf(w, "%s: %s\r\n", f.name, f.value)
 		if err != nil {
 			return err
 		}
 	}
-	_, err := fmt.Fprintf(w, "\r\n")
+	return nil
+}
 
-	return err
+var REQ_LINE_SEP = []byte("\r\n")
+var FIELD_SEP = []byte(":")
+
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
+// SetLenient makes Parse accept obsolete line folding (a field value
+// continued on a line starting with whitespace), replacing each fold with a
+// single space. Otherwise folded lines are rejected with ErrObsFold.
+func (h *Headers) SetLenient(lenient bool) {
+	h.lenient = lenient
+}
 
+// Valid checks every field name against the token grammar and every value
+// against the field-value grammar of RFC 9110
+func (h *Headers) Valid() error {
+	for name, val := range h.All() {
+		if !validTokens([]byte(name)) {
+			return fmt.Errorf("%w %q", ErrInvalidName, name)
+		}
+		if !ValidValue(val) {
+			return fmt.Errorf("%w for %s: %q", ErrInvalidValue, name, val)
+		}
+	}
+	return nil
+}
 
-var REQ_LINE_SEP = []byte("\r\n")
-var FIELD_SEP = []byte(":")
+// Get returns the value of the field key. A field sent on several lines is
+// combined into one value separated by ", ", as RFC 9110 allows for list
+// fields. Use Values for the separate lines.
+func (h *Headers) Get(key string) (string, bool) {
+	vals := h.Values(key)
+	if len(vals) == 0 {
+		return "", false
+	}
+	return strings.Join(vals, ", "), true
+}
+
+// Values returns every value of the field key in the order they were added
+func (h *Headers) Values(key string) []string {
+	var vals []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			vals = append(vals, f.value)
+		}
+	}
+	return vals
+}
+
+func (h *Headers) Has(key string) bool {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends a field line, keeping any lines already there for key
+func (h *Headers) Add(key, val string) {
+	h.fields = append(h.fields, field{key, val})
+}
+
+// Set replaces every line for key with a single one. The new line takes the
+// place of the first old one, or goes at the end if key wasn't there.
+func (h *Headers) Set(key, val string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			h.fields[i] = field{key, val}
+			h.deleteFrom(i+1, key)
+			return
+		}
+	}
+	h.Add(key, val)
+}
+
+// Replace is the old name for Set
+func (h *Headers) Replace(key, val string) {
+	h.Set(key, val)
+}
+
+// Del removes every line for key
+func (h *Headers) Del(key string) {
+	h.deleteFrom(0, key)
+}
 
-func NewHeaders() Headers {
-	return map[string]string{}
+func (h *Headers) deleteFrom(start int, key string) {
+	kept := h.fields[:start]
+	for _, f := range h.fields[start:] {
+		if !strings.EqualFold(f.name, key) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	val, ok := h[strings.ToLower(key)]
-	return val, ok
+// Len returns the number of field lines
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
 }
 
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.fields)}
+}
 
+// All iterates over every field line in order, with names as they were added
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+		for _, f := range h.fields {
+			if !yield(f.name, f.value) {
+				return
+			}
+		}
+	}
+}
+
+// Canonicalize renames every field to its CanonicalKey form
+func (h *Headers) Canonicalize() {
+	for i := range h.Len() {
+		f := &h.fields[i]
+		f.name = CanonicalKey(f.name)
+		if f.name == "Trailer" {
+			// the declared names have to match the trailer fields, which
+			// get canonicalized too
+			names := strings.Split(f.value, ",")
+			for j, name := range names {
+				names[j] = CanonicalKey(strings.TrimSpace(name))
+			}
+			f.value = strings.Join(names, ", ")
+		}
+	}
+}
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// CanonicalKey returns key with the first letter of every hyphenated part in
+// upper case and the rest in lower case, e.g. "content-length" becomes
+// "Content-Length". In keys that mix cases, parts written all in upper case
+// are taken as acronyms and kept, so "X-Content-SHA256" stays as it is while
+// "CONTENT-LENGTH" becomes "Content-Length". Keys that aren't valid tokens
+// are returned as is.
+func CanonicalKey(key string) string {
+	if !validTokens([]byte(key)) {
+		return key
+	}
+	mixed := strings.ToUpper(key) != key && strings.ToLower(key) != key
+	parts := strings.Split(key, "-")
+	for i, part := range parts {
+		if mixed && strings.ToUpper(part) == part {
+			continue
+		}
+		b := []byte(strings.ToLower(part))
+		if len(b) > 0 && 'a' <= b[0] && b[0] <= 'z' {
+			b[0] -= 'a' - 'A'
+		}
+		parts[i] = string(b)
+	}
+	return strings.Join(parts, "-")
+}
 
-	//allLetter := regexp.MustCompile(`^[a-zA-Z]+$`).MatchString
+// HasToken reports whether the comma separated list in the field key contains
+// token, compared case-insensitively (e.g. "Connection: keep-alive, Upgrade")
+func (h *Headers) HasToken(key, token string) bool {
+	val, ok := h.Get(key)
+	if !ok {
+		return false
+	}
+	for _, t := range strings.Split(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+
+
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	idx := bytes.Index(data, REQ_LINE_SEP)
 	if idx == -1 {
 		return 0, false, nil
@@ -63,59 +269,85 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 2, true, nil
 	}
 	line := data[:idx] // get data on this line, before the \r\n
-	lineTrim := bytes.TrimSpace(line)
+	lineTrim := bytes.TrimLeft(line, " \t")
+	if len(lineTrim) != len(line) && h.Len() > 0 {
+		// whitespace at the start of a line continues the previous field
+		return h.parseFold(line)
+	}
 	// separate field name and field value
 	idx = bytes.Index(lineTrim, FIELD_SEP)
 	if idx == -1 {
-		return 0, false, fmt.Errorf("no colon found separating field name and value")
+		return 0, false, ErrMissingColon
 	}
 	if idx == 0 {
-		return 0, false, fmt.Errorf("no field name given before colon")
-	}
-	if idx == len(lineTrim) {
-		return 0, false, fmt.Errorf("there is no value for the field, the colon was at the end of the line")
+		return 0, false, ErrMissingName
 	}
-	fieldName := bytes.ToLower(lineTrim[:idx])
-	if len(fieldName) != len(bytes.TrimSpace(fieldName)) {
-		return 0, false, fmt.Errorf("there should be no whitespace between the field name and ':', or there must be a field name")
+	fieldName := lineTrim[:idx]
+	if len(fieldName) != len(bytes.TrimRight(fieldName, " \t")) {
+		return 0, false, ErrSpaceBeforeColon
 	}
 	if !validTokens(fieldName) {
-		return 0, false, fmt.Errorf("invalid field name (header token) %s", fieldName)
+		return 0, false, fmt.Errorf("%w %q", ErrInvalidName, fieldName)
 	}
-	
-	fieldValue := bytes.TrimSpace(lineTrim[idx+len(FIELD_SEP):])
 
-	h.Set(string(fieldName), string(fieldValue))
+	fieldValue := bytes.Trim(lineTrim[idx+len(FIELD_SEP):], " \t")
+	if !ValidValue(string(fieldValue)) {
+		return 0, false, fmt.Errorf("%w for %s: %q", ErrInvalidValue, fieldName, fieldValue)
+	}
+
+	h.Add(string(fieldName), string(fieldValue))
 
 	return len(line) + len(REQ_LINE_SEP), false, nil
 }
 
-func (h Headers) Set(key, val string) {
-	key = strings.ToLower(key)
-	oldVal, ok := h[key]
-	if ok {
-		h[key] = fmt.Sprintf("%s, %s", oldVal, val)
-	} else {
-		h[key] = val
+// parseFold handles a line continuing the previous field's value
+func (h *Headers) parseFold(line []byte) (int, bool, error) {
+	if !h.lenient {
+		return 0, false, ErrObsFold
 	}
+	cont := bytes.Trim(line, " \t")
+	if !ValidValue(string(cont)) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidValue, cont)
+	}
+	last := &h.fields[len(h.fields)-1]
+	if len(cont) > 0 {
+		if last.value != "" {
+			last.value += " "
+		}
+		last.value += string(cont)
+	}
+	return len(line) + len(REQ_LINE_SEP), false, nil
 }
 
-func (h Headers) Replace(key, val string) {
-	h[strings.ToLower(key)] = val
-}
-
+// validTokens reports whether data is a token: one or more tchars as defined
+// in RFC 9110 section 5.6.2
 func validTokens(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
 	for _, c := range data {
-		if ((c < 'A' || c > 'Z') &&
-			(c < 'a' || c > 'z') &&
-			(c < '0' || c > '9') &&
-			c != '-') {
-					return false
-				}
+		if !isTchar(c) {
+			return false
 		}
-		return true
+	}
+	return true
 }
 
+func isTchar(c byte) bool {
+	return ('A' <= c && c <= 'Z') ||
+		('a' <= c && c <= 'z') ||
+		('0' <= c && c <= '9') ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
 
-
-
+// ValidValue reports whether s can be sent as a field value: visible ASCII,
+// spaces, tabs and obs-text, but no other control characters such as CR or LF
+func ValidValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -1,12 +1,18 @@
 package headers
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func get(h *Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
 func TestHeadersParse(t *testing.T) {
 	// Test: Valid single header
 	headers := NewHeaders()
@@ -14,7 +20,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -24,18 +30,19 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 57, n)
 	assert.False(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(headers, "user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -45,7 +52,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Empty(t, headers)
+	assert.Equal(t, 0, headers.Len())
 	assert.Equal(t, 2, n)
 	assert.True(t, done)
 
@@ -66,13 +73,160 @@ func TestHeadersParse(t *testing.T) {
 	assert.False(t, done)
 	
 	// Test: Same header key
-	headers = map[string]string{"host": "localhost:8000"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:8000")
 	data = []byte("Host: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:8000, localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:8000, localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 }
 
+
+func TestHeadersHasToken(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Connection", "keep-alive, Upgrade")
+	assert.True(t, headers.HasToken("connection", "upgrade"))
+	assert.True(t, headers.HasToken("Connection", "Keep-Alive"))
+	assert.False(t, headers.HasToken("Connection", "close"))
+	assert.False(t, headers.HasToken("Transfer-Encoding", "chunked"))
+}
+
+func TestHeadersParseErrors(t *testing.T) {
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("Host localhost\r\n\r\n"))
+	require.ErrorIs(t, err, ErrMissingColon)
+	_, _, err = headers.Parse([]byte(": localhost\r\n\r\n"))
+	require.ErrorIs(t, err, ErrMissingName)
+	_, _, err = headers.Parse([]byte("Host : localhost\r\n\r\n"))
+	require.ErrorIs(t, err, ErrSpaceBeforeColon)
+	_, _, err = headers.Parse([]byte("H©st: localhost\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidName)
+}
+
+func TestHeadersOrder(t *testing.T) {
+	// Test: Write keeps insertion order and casing
+	h := NewHeaders()
+	h.Add("Zeta", "1")
+	h.Add("alpha", "2")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2; Path=/")
+	var buf bytes.Buffer
+	require.NoError(t, h.Write(&buf))
+	assert.Equal(t, "Zeta: 1\r\nalpha: 2\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2; Path=/\r\n\r\n", buf.String())
+
+	// Test: Values keeps repeated fields apart
+	assert.Equal(t, []string{"a=1", "b=2; Path=/"}, h.Values("set-cookie"))
+	assert.Nil(t, h.Values("missing"))
+
+	// Test: Set replaces every line in place of the first
+	h.Set("SET-COOKIE", "c=3")
+	var names []string
+	for name := range h.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Zeta", "alpha", "SET-COOKIE"}, names)
+	assert.Equal(t, 3, h.Len())
+
+	// Test: Clone is independent
+	c := h.Clone()
+	c.Del("zeta")
+	assert.False(t, c.Has("Zeta"))
+	assert.True(t, h.Has("Zeta"))
+	assert.Equal(t, 2, c.Len())
+
+	// Test: Parse keeps the original casing
+	h = NewHeaders()
+	_, _, err := h.Parse([]byte("X-Request-ID: 7\r\n"))
+	require.NoError(t, err)
+	for name, val := range h.All() {
+		assert.Equal(t, "X-Request-ID", name)
+		assert.Equal(t, "7", val)
+	}
+}
+
+func TestCanonicalKey(t *testing.T) {
+	assert.Equal(t, "Content-Length", CanonicalKey("content-length"))
+	assert.Equal(t, "Content-Length", CanonicalKey("CONTENT-LENGTH"))
+	assert.Equal(t, "X-Content-Sha256", CanonicalKey("x-content-sha256"))
+	assert.Equal(t, "Www-Authenticate", CanonicalKey("www-authenticate"))
+
+	// Test: all caps parts of mixed case keys are kept
+	assert.Equal(t, "X-Content-SHA256", CanonicalKey("X-Content-SHA256"))
+	assert.Equal(t, "X-Content-SHA256", CanonicalKey("x-content-SHA256"))
+	assert.Equal(t, "X-Request-ID", CanonicalKey("x-request-ID"))
+	assert.Equal(t, "WWW-Authenticate", CanonicalKey("WWW-authenticate"))
+
+	// Test: names in the Trailer value are canonicalized like field names
+	h := NewHeaders()
+	h.Set("trailer", "x-checksum,X-Content-SHA256")
+	h.Set("x-checksum", "1")
+	h.Canonicalize()
+	for name, val := range h.All() {
+		if name != "X-Checksum" {
+			assert.Equal(t, "Trailer", name)
+			assert.Equal(t, "X-Checksum, X-Content-SHA256", val)
+		}
+	}
+	assert.Equal(t, "bad key", CanonicalKey("bad key"))
+	assert.Equal(t, "", CanonicalKey(""))
+}
+
+func TestHeadersValidation(t *testing.T) {
+	// Test: every tchar is allowed in a name
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("X!#$%&'*+-.^_`|~9: ok\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", get(headers, "x!#$%&'*+-.^_`|~9"))
+
+	// Test: control characters in a value
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("X-Bad: a\x00b\r\n"))
+	require.ErrorIs(t, err, ErrInvalidValue)
+	_, _, err = headers.Parse([]byte("X-Bad: a\rb\r\n"))
+	require.ErrorIs(t, err, ErrInvalidValue)
+
+	// Test: tabs and obs-text are fine
+	_, _, err = headers.Parse([]byte("X-Ok: a\tb \xe9\r\n"))
+	require.NoError(t, err)
+
+	// Test: Write refuses values that would inject a line
+	headers = NewHeaders()
+	headers.Set("X-Name", "evil\r\nSet-Cookie: admin=1")
+	var buf bytes.Buffer
+	require.ErrorIs(t, headers.Write(&buf), ErrInvalidValue)
+	assert.Empty(t, buf.String())
+
+	headers = NewHeaders()
+	headers.Set("Bad Name", "x")
+	require.ErrorIs(t, headers.Write(&buf), ErrInvalidName)
+	assert.Empty(t, buf.String())
+}
+
+func TestHeadersObsFold(t *testing.T) {
+	data := []byte("X-Long: first\r\n  second\r\n\tthird\r\n\r\n")
+
+	// Test: folding is rejected by default
+	headers := NewHeaders()
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.ErrorIs(t, err, ErrObsFold)
+
+	// Test: lenient mode joins the lines with a space
+	headers = NewHeaders()
+	headers.SetLenient(true)
+	read := 0
+	for {
+		n, done, err := headers.Parse(data[read:])
+		require.NoError(t, err)
+		read += n
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, len(data), read)
+	assert.Equal(t, []string{"first second third"}, headers.Values("X-Long"))
+}
@@ -0,0 +1,114 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// parseChunkSize parses the line that starts every chunk of a chunked body:
+//
+//	chunk-size [ ; ext-name [ = ext-value ] ]... CRLF
+//
+// Extensions are checked for syntax and then ignored. It returns 0 bytes read
+// if the line isn't complete yet.
+func parseChunkSize(data []byte) (size int, n int, err error) {
+	idx := bytes.Index(data, REQ_LINE_SEP)
+	if idx == -1 {
+		return 0, 0, nil
+	}
+	line := data[:idx]
+
+	sizePart := line
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		sizePart = line[:i]
+		if err := checkChunkExtensions(line[i:]); err != nil {
+			return 0, 0, err
+		}
+	}
+	sizePart = bytes.TrimRight(sizePart, " \t")
+	if len(sizePart) == 0 {
+		return 0, 0, fmt.Errorf("missing chunk size")
+	}
+	for _, c := range sizePart {
+		if !isHexDigit(c) {
+			return 0, 0, fmt.Errorf("invalid chunk size %q", sizePart)
+		}
+	}
+	s, err := strconv.ParseUint(string(sizePart), 16, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("chunk size %q is too large", sizePart)
+	}
+	return int(s), idx + len(REQ_LINE_SEP), nil
+}
+
+// checkChunkExtensions validates a run of ";name" or ";name=value" pairs where
+// value is a token or a quoted string
+func checkChunkExtensions(ext []byte) error {
+	for len(ext) > 0 {
+		ext = bytes.TrimLeft(ext, " \t")
+		if len(ext) == 0 || ext[0] != ';' {
+			return fmt.Errorf("invalid chunk extension %q", ext)
+		}
+		ext = bytes.TrimLeft(ext[1:], " \t")
+
+		i := 0
+		for i < len(ext) && isTokenChar(ext[i]) {
+			i++
+		}
+		if i == 0 {
+			return fmt.Errorf("chunk extension has no name")
+		}
+		ext = bytes.TrimLeft(ext[i:], " \t")
+		if len(ext) == 0 || ext[0] == ';' {
+			continue
+		}
+		if ext[0] != '=' {
+			return fmt.Errorf("invalid chunk extension %q", ext)
+		}
+		ext = bytes.TrimLeft(ext[1:], " \t")
+
+		if len(ext) > 0 && ext[0] == '"' {
+			end := closingQuote(ext)
+			if end == -1 {
+				return fmt.Errorf("unterminated quoted chunk extension value")
+			}
+			ext = ext[end+1:]
+			continue
+		}
+		i = 0
+		for i < len(ext) && isTokenChar(ext[i]) {
+			i++
+		}
+		if i == 0 {
+			return fmt.Errorf("chunk extension has an empty value")
+		}
+		ext = ext[i:]
+	}
+	return nil
+}
+
+// closingQuote returns the index of the quote that ends the quoted string
+// starting at s[0], honouring backslash escapes
+func closingQuote(s []byte) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func isTokenChar(c byte) bool {
+	if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+		return true
+	}
+	return bytes.IndexByte([]byte("!#$%&'*+-.^_`|~"), c) != -1
+}
@@ -0,0 +1,98 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrMalformedRequestLine      = errors.New("malformed request line")
+	ErrInvalidMethod             = errors.New("invalid method")
+	ErrUnsupportedVersion        = errors.New("unsupported HTTP version")
+	ErrInvalidTarget             = errors.New("invalid request target")
+	ErrMalformedHeader           = errors.New("malformed header field")
+	ErrInvalidContentLength      = errors.New("invalid content-length")
+	ErrUnsupportedTransferCoding = errors.New("unsupported transfer coding")
+	ErrMalformedChunk            = errors.New("malformed chunk")
+	ErrMalformedTrailer          = errors.New("malformed trailer field")
+	ErrBareLF                    = errors.New("line ended with LF instead of CRLF")
+	ErrLeadingWhitespace         = errors.New("whitespace between the request line and the first header field")
+	ErrInvalidTransferEncoding   = errors.New("invalid transfer-encoding")
+	ErrConflictingContentLength  = errors.New("conflicting content-length values")
+	// ErrContentLengthWithTransferEncoding is returned when a request has
+	// both headers, which is how most smuggling attacks start
+	ErrContentLengthWithTransferEncoding = errors.New("both content-length and transfer-encoding")
+	// ErrRequestTimeout is returned when a read deadline passes in the middle
+	// of a request. The Cause then matches os.ErrDeadlineExceeded.
+	ErrRequestTimeout = errors.New("timed out reading the request")
+	// ErrParserState means the parser itself went wrong, not the request
+	ErrParserState = errors.New("request parser is in an unknown state")
+	// the two below also match io.ErrUnexpectedEOF
+	ErrIncompleteRequest = fmt.Errorf("connection closed before the end of the headers: %w", io.ErrUnexpectedEOF)
+	ErrBodyTooShort      = fmt.Errorf("connection closed before the end of the body: %w", io.ErrUnexpectedEOF)
+)
+
+// statusCodes is the response status suggested for each parse error
+var statusCodes = map[error]int{
+	ErrMalformedRequestLine:              400,
+	ErrInvalidMethod:                     400,
+	ErrUnsupportedVersion:                505,
+	ErrInvalidTarget:                     400,
+	ErrMalformedHeader:                   400,
+	ErrInvalidContentLength:              400,
+	ErrUnsupportedTransferCoding:         501,
+	ErrMalformedChunk:                    400,
+	ErrMalformedTrailer:                  400,
+	ErrBareLF:                            400,
+	ErrLeadingWhitespace:                 400,
+	ErrInvalidTransferEncoding:           400,
+	ErrConflictingContentLength:          400,
+	ErrContentLengthWithTransferEncoding: 400,
+	ErrIncompleteRequest:                 400,
+	ErrBodyTooShort:                      400,
+	ErrRequestTimeout:                    408,
+	ErrParserState:                       500,
+	ErrRequestLineTooLong:                414,
+	ErrHeadersTooLarge:                   431,
+	ErrBodyTooLarge:                      413,
+}
+
+// ParseError is returned for every request the parser rejects. Err is one of
+// the Err values in this package, so callers can use errors.Is.
+type ParseError struct {
+	Err error
+	// StatusCode is the response status the server should answer with
+	StatusCode int
+	// Offset is how many bytes into the request the problem was found
+	Offset int
+	// Cause is the underlying error, if any, such as a headers package error
+	Cause error
+}
+
+func (e *ParseError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%v at byte %d: %v", e.Err, e.Offset, e.Cause)
+	}
+	return fmt.Sprintf("%v at byte %d", e.Err, e.Offset)
+}
+
+func (e *ParseError) Unwrap() []error {
+	if e.Cause != nil {
+		return []error{e.Err, e.Cause}
+	}
+	return []error{e.Err}
+}
+
+func newParseError(err error, offset int, cause error) *ParseError {
+	code, ok := statusCodes[err]
+	if !ok {
+		code = 400
+	}
+	return &ParseError{
+		Err:        err,
+		StatusCode: code,
+		Offset:     offset,
+		Cause:      cause,
+	}
+}
@@ -0,0 +1,243 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrNotForm      = errors.New("request body is not application/x-www-form-urlencoded")
+	ErrNotMultipart = errors.New("request body is not multipart/form-data")
+	ErrFormTooLarge = errors.New("form too large")
+	ErrTooManyParts = errors.New("too many parts in multipart form")
+)
+
+// FormLimits bounds how much of a form body is accepted. A zero field means
+// no limit.
+type FormLimits struct {
+	// MaxBytes caps the whole encoded body
+	MaxBytes int64
+	// MaxParts caps the number of parts in a multipart form
+	MaxParts int
+	// MaxMemory is how big a file part can get before it is moved from
+	// memory into a temporary file
+	MaxMemory int64
+}
+
+func DefaultFormLimits() FormLimits {
+	return FormLimits{
+		MaxBytes:  32 << 20,
+		MaxParts:  1000,
+		MaxMemory: 1 << 20,
+	}
+}
+
+// MultipartForm is a parsed multipart/form-data body. File parts are those
+// sent with a filename.
+type MultipartForm struct {
+	Value Values
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll deletes the temporary files behind the form's file parts
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpfile != "" {
+				errs = append(errs, os.Remove(fh.tmpfile))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileHeader describes an uploaded file from a multipart form
+type FileHeader struct {
+	// Filename is the base name the client sent, without any directories
+	Filename string
+	Header   *headers.Headers
+	Size     int64
+
+	content []byte
+	tmpfile string
+}
+
+// Open returns the file's contents, from memory or from its temporary file
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return io.NopCloser(bytes.NewReader(fh.content)), nil
+}
+
+// ParseForm decodes an application/x-www-form-urlencoded body of up to
+// limits.MaxBytes. It reads the body through BodyReader, so it works for
+// streamed bodies too, and the result is kept for later calls.
+func (r *Request) ParseForm(limits FormLimits) (Values, error) {
+	if r.form != nil {
+		return r.form, nil
+	}
+	mediaType, _, err := r.contentType()
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil, ErrNotForm
+	}
+
+	body, err := io.ReadAll(&formBodyReader{r: r.BodyReader, limit: limits.MaxBytes})
+	if err != nil {
+		return nil, err
+	}
+	form, err := ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid form body: %w", err)
+	}
+	r.form = form
+	return form, nil
+}
+
+// MultipartReader returns a reader over the parts of a multipart/form-data
+// body, for handlers that want to stream each part themselves
+func (r *Request) MultipartReader() (*multipart.Reader, error) {
+	mediaType, params, err := r.contentType()
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: no boundary", ErrNotMultipart)
+	}
+	return multipart.NewReader(r.BodyReader, boundary), nil
+}
+
+// ParseMultipartForm reads a whole multipart/form-data body. Small file
+// parts stay in memory, bigger ones are written to temporary files that the
+// caller removes with RemoveAll. The result is kept for later calls.
+func (r *Request) ParseMultipartForm(limits FormLimits) (*MultipartForm, error) {
+	if r.multipartForm != nil {
+		return r.multipartForm, nil
+	}
+	mediaType, params, err := r.contentType()
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ErrNotMultipart
+	}
+	mr := multipart.NewReader(&formBodyReader{r: r.BodyReader, limit: limits.MaxBytes}, params["boundary"])
+
+	form := &MultipartForm{Value: Values{}, File: map[string][]*FileHeader{}}
+	for parts := 1; ; parts++ {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+		if limits.MaxParts > 0 && parts > limits.MaxParts {
+			part.Close()
+			form.RemoveAll()
+			return nil, ErrTooManyParts
+		}
+		name := part.FormName()
+		if part.FileName() == "" {
+			val, err := io.ReadAll(part)
+			part.Close()
+			if err != nil {
+				form.RemoveAll()
+				return nil, err
+			}
+			form.Value[name] = append(form.Value[name], string(val))
+			continue
+		}
+
+		fh, err := readFilePart(part, limits.MaxMemory)
+		part.Close()
+		if fh != nil {
+			form.File[name] = append(form.File[name], fh)
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+	}
+	r.multipartForm = form
+	return form, nil
+}
+
+// readFilePart keeps the part in memory up to maxMemory bytes and spills it
+// to a temporary file past that
+func readFilePart(part *multipart.Part, maxMemory int64) (*FileHeader, error) {
+	fh := &FileHeader{
+		Filename: filepath.Base(part.FileName()),
+		Header:   headers.NewHeaders(),
+	}
+	for key, vals := range part.Header {
+		for _, val := range vals {
+			fh.Header.Add(key, val)
+		}
+	}
+
+	var buf bytes.Buffer
+	src := io.Reader(part)
+	if maxMemory > 0 {
+		src = io.LimitReader(part, maxMemory+1)
+	}
+	n, err := io.Copy(&buf, src)
+	if err != nil {
+		return nil, err
+	}
+	if maxMemory <= 0 || n <= maxMemory {
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return fh, nil
+	}
+
+	file, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fh.tmpfile = file.Name()
+	size, err := io.Copy(file, io.MultiReader(&buf, part))
+	fh.Size = size
+	return fh, err
+}
+
+func (r *Request) contentType() (string, map[string]string, error) {
+	ct, ok := r.Headers.Get("Content-Type")
+	if !ok {
+		return "", nil, fmt.Errorf("no content-type")
+	}
+	return mime.ParseMediaType(ct)
+}
+
+// formBodyReader fails with ErrFormTooLarge once the body goes past limit
+// bytes. Nothing past the limit is handed out, so a reader that buffers ahead
+// still runs into the error.
+type formBodyReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (f *formBodyReader) Read(p []byte) (int, error) {
+	if f.limit > 0 && f.read > f.limit {
+		return 0, ErrFormTooLarge
+	}
+	if f.limit > 0 && int64(len(p)) > f.limit-f.read+1 {
+		p = p[:f.limit-f.read+1]
+	}
+	n, err := f.r.Read(p)
+	f.read += int64(n)
+	if f.limit > 0 && f.read > f.limit {
+		return n - int(f.read-f.limit), ErrFormTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The checks in this file keep the parser from reading a different message
+// boundary than a proxy in front of it would (request smuggling). Anything
+// ambiguous is rejected instead of guessed at, following RFC 9112 section 6.
+
+// bodyFraming works out how the body is delimited. It returns chunked, or
+// the Content-Length with -1 meaning there is no body.
+func (r *Request) bodyFraming() (chunked bool, length int, err error) {
+	te := r.Headers.Values("Transfer-Encoding")
+	cl := r.Headers.Values("Content-Length")
+	if len(te) > 0 && len(cl) > 0 {
+		return false, 0, newParseError(ErrContentLengthWithTransferEncoding, 0, nil)
+	}
+	if len(te) > 0 && r.RequestLine.HttpVersion == "1.0" {
+		// HTTP/1.0 has no chunked encoding, so the framing is faulty
+		// (RFC 9112 section 6.1)
+		return false, 0, newParseError(ErrInvalidTransferEncoding, 0, fmt.Errorf("transfer-encoding in an HTTP/1.0 request"))
+	}
+	if len(te) > 0 {
+		return true, 0, checkTransferCodings(te)
+	}
+	if len(cl) == 0 {
+		return false, -1, nil
+	}
+	length, err = parseContentLength(cl)
+	return false, length, err
+}
+
+// checkTransferCodings only accepts a single "chunked". Other codings aren't
+// supported, and chunked has to be the final one to know where the body ends.
+func checkTransferCodings(lines []string) error {
+	var codings []string
+	for _, line := range lines {
+		for _, c := range strings.Split(line, ",") {
+			codings = append(codings, strings.TrimSpace(c))
+		}
+	}
+	for i, c := range codings {
+		switch {
+		case c == "":
+			return newParseError(ErrInvalidTransferEncoding, 0, fmt.Errorf("empty transfer coding in %q", lines))
+		case strings.EqualFold(c, "chunked"):
+			if i != len(codings)-1 {
+				return newParseError(ErrInvalidTransferEncoding, 0, fmt.Errorf("chunked is not the final coding in %q", lines))
+			}
+		default:
+			return newParseError(ErrUnsupportedTransferCoding, 0, fmt.Errorf("%q", c))
+		}
+	}
+	return nil
+}
+
+// parseContentLength accepts repeated Content-Length values, on separate
+// lines or as a list, only if they are all the same
+func parseContentLength(lines []string) (int, error) {
+	length := -1
+	for _, line := range lines {
+		for _, v := range strings.Split(line, ",") {
+			v = strings.TrimSpace(v)
+			n, err := parseDigits(v)
+			if err != nil {
+				return 0, newParseError(ErrInvalidContentLength, 0, err)
+			}
+			if length != -1 && n != length {
+				return 0, newParseError(ErrConflictingContentLength, 0, fmt.Errorf("%q", lines))
+			}
+			length = n
+		}
+	}
+	return length, nil
+}
+
+// parseDigits is strconv.Atoi without the sign, which Content-Length doesn't
+// allow
+func parseDigits(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty value")
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, fmt.Errorf("%q is not a number", s)
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// checkBareLF looks at the line at the start of data and returns an error if
+// it is ended by a LF without the CR in front of it
+func checkBareLF(data []byte) error {
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 || (i > 0 && data[i-1] == '\r') {
+		return nil
+	}
+	return newParseError(ErrBareLF, i, nil)
+}
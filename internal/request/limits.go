@@ -0,0 +1,39 @@
+package request
+
+import "errors"
+
+// Limits bounds how much of a request the parser will accept. A zero field
+// means no limit.
+type Limits struct {
+	// MaxRequestLineBytes caps the request line, without its CRLF
+	MaxRequestLineBytes int
+	// MaxHeaderBytes caps the header section plus the trailer section of a
+	// chunked body, counting every field line and its CRLF
+	MaxHeaderBytes int
+	// MaxHeaderCount caps the number of header and trailer field lines
+	MaxHeaderCount int
+	// MaxBodyBytes caps the decoded body
+	MaxBodyBytes int
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxRequestLineBytes: 8 << 10,
+		MaxHeaderBytes:      64 << 10,
+		MaxHeaderCount:      100,
+		MaxBodyBytes:        10 << 20,
+	}
+}
+
+// maxChunkLineBytes caps a chunk size line including its extensions
+const maxChunkLineBytes = 4 << 10
+
+var (
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeadersTooLarge    = errors.New("header section too large")
+	ErrBodyTooLarge       = errors.New("request body too large")
+)
+
+func exceeds(n, limit int) bool {
+	return limit > 0 && n > limit
+}
@@ -0,0 +1,272 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxDrain is how much of an unread streaming body Close will read and throw
+// away to get to the next request. Bigger leftovers leave the stream unusable.
+const maxDrain = 256 << 10
+
+var ErrBodyNotDrained = errors.New("request body was not read to the end")
+
+// Reader reads consecutive requests from one connection. Bytes read past the
+// end of one request are kept and used for the next one.
+type Reader struct {
+	reader io.Reader
+	buf    []byte
+	bufLen int
+	limits Limits
+	// lenient accepts obsolete line folding in headers and trailers
+	lenient bool
+
+	// body is the streaming body of the last request, which has to be read
+	// or closed before the next request can be parsed
+	body *bodyReader
+	// err is set once the stream can no longer be parsed
+	err error
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, 1024),
+		limits: DefaultLimits(),
+	}
+}
+
+// SetLimits replaces the limits applied to requests read from now on
+func (rr *Reader) SetLimits(limits Limits) {
+	rr.limits = limits
+}
+
+// SetLenient makes requests read from now on accept obsolete line folding in
+// headers and trailers, replacing each fold with a space. By default folded
+// lines are rejected.
+func (rr *Reader) SetLenient(lenient bool) {
+	rr.lenient = lenient
+}
+
+// ReadRequest reads the next request from the stream, including its whole
+// body. It returns io.EOF if the stream ended cleanly before any byte of a new
+// request arrived.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	req, err := rr.next(false)
+	if err != nil {
+		return nil, err
+	}
+	err = rr.parseUntil(req, req.done)
+	if err != nil {
+		return nil, err
+	}
+	req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
+	return req, nil
+}
+
+// ReadStreamingRequest reads the next request up to the end of its headers.
+// The body is left on the stream for req.BodyReader, which must be read to
+// EOF or closed before the next request is read. Closing discards whatever is
+// left of the body.
+func (rr *Reader) ReadStreamingRequest() (*Request, error) {
+	req, err := rr.next(true)
+	if err != nil {
+		return nil, err
+	}
+	err = rr.parseUntil(req, req.headersDone)
+	if err != nil {
+		return nil, err
+	}
+	rr.body = req.stream
+	req.BodyReader = req.stream
+	return req, nil
+}
+
+// BufferBody reads the rest of a body left on the stream by
+// ReadStreamingRequest into req.Body, so req looks like one returned by
+// ReadRequest. Nothing may have been read from req.BodyReader yet.
+func (rr *Reader) BufferBody(req *Request) error {
+	if req.stream == nil {
+		return nil
+	}
+	req.Body = append(req.Body, req.stream.buf...)
+	req.stream = nil
+	rr.body = nil
+	if err := rr.parseUntil(req, req.done); err != nil {
+		return err
+	}
+	req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
+	return nil
+}
+
+func (rr *Reader) next(streaming bool) (*Request, error) {
+	if rr.body != nil {
+		err := rr.body.drain()
+		rr.body = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rr.err != nil {
+		return nil, rr.err
+	}
+	req := newRequest()
+	req.limits = rr.limits
+	req.Headers.SetLenient(rr.lenient)
+	req.Trailers.SetLenient(rr.lenient)
+	if streaming {
+		req.stream = &bodyReader{rr: rr, req: req}
+	}
+	return req, nil
+}
+
+// parseUntil feeds buffered and newly read bytes to the request parser until
+// stop reports true
+func (rr *Reader) parseUntil(req *Request, stop func() bool) error {
+	if rr.err != nil {
+		return rr.err
+	}
+	// there may already be a whole request waiting from the last read
+	if rr.bufLen > 0 {
+		nParsed, err := req.parse(rr.buf[:rr.bufLen])
+		if err != nil {
+			rr.err = err
+			return err
+		}
+		rr.consume(nParsed)
+	}
+	for !stop() {
+		if rr.bufLen >= len(rr.buf) {
+			newBuf := make([]byte, 2*len(rr.buf))
+			copy(newBuf, rr.buf)
+			rr.buf = newBuf
+
+		}
+		nRead, err := rr.reader.Read(rr.buf[rr.bufLen:])
+		rr.bufLen += nRead
+		if nRead > 0 {
+			nParsed, perr := req.parse(rr.buf[:rr.bufLen])
+			if perr != nil {
+				rr.err = perr
+				return perr
+			}
+			rr.consume(nParsed)
+		}
+		if err != nil {
+			if stop() {
+				break
+			}
+			started := req.state != StateInit || rr.bufLen > 0
+			if errors.Is(err, io.EOF) && started {
+				if req.headersDone() {
+					err = newParseError(ErrBodyTooShort, req.consumed, nil)
+				} else {
+					err = newParseError(ErrIncompleteRequest, req.consumed+rr.bufLen, nil)
+				}
+			} else if errors.Is(err, os.ErrDeadlineExceeded) && started {
+				err = newParseError(ErrRequestTimeout, req.consumed+rr.bufLen, err)
+			}
+			rr.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait blocks until some of the next request has arrived, so the wait for a
+// request can be timed apart from reading it. It returns io.EOF if the stream
+// ends first.
+func (rr *Reader) Wait() error {
+	if rr.err != nil {
+		return rr.err
+	}
+	for rr.bufLen == 0 {
+		nRead, err := rr.reader.Read(rr.buf)
+		rr.bufLen += nRead
+		if nRead == 0 && err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buffered returns the number of bytes already read from the stream that
+// belong to requests not yet returned
+func (rr *Reader) Buffered() int {
+	return rr.bufLen
+}
+
+func (rr *Reader) consume(n int) {
+	copy(rr.buf, rr.buf[n:rr.bufLen])
+	rr.bufLen -= n
+}
+
+// bodyReader streams a request body off the connection. The parser appends
+// decoded body bytes to buf and Read hands them out.
+type bodyReader struct {
+	rr     *Reader
+	req    *Request
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fmt.Errorf("read on closed request body")
+	}
+	return b.read(p)
+}
+
+func (b *bodyReader) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(b.buf) == 0 {
+		b.buf = b.buf[:0]
+		err := b.rr.parseUntil(b.req, func() bool { return len(b.buf) > 0 || b.req.done() })
+		if err != nil {
+			b.err = err
+			return 0, err
+		}
+		if len(b.buf) == 0 {
+			b.err = io.EOF
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Close discards the rest of the body so the next request can be read. It
+// fails with ErrBodyNotDrained if too much of the body was left.
+func (b *bodyReader) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.drain()
+}
+
+func (b *bodyReader) drain() error {
+	_, err := io.CopyN(io.Discard, readerFunc(b.read), maxDrain)
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil
+	case err == nil:
+		b.rr.err = ErrBodyNotDrained
+		return ErrBodyNotDrained
+	default:
+		return err
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
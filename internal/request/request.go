@@ -3,11 +3,13 @@ package request
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
-	"strconv"
+	"strings"
 
+	"github.com/peter-howell/httpfromtcp/internal/cookie"
 	"github.com/peter-howell/httpfromtcp/internal/headers"
 )
 
@@ -26,15 +28,37 @@ const (
 	StateInit parserState = "init"
 	StateParseHeaders parserState = "parsingHeaders"
 	StateParseBody parserState = "parsingBody"
+	StateParseChunkSize parserState = "parsingChunkSize"
+	StateParseChunkData parserState = "parsingChunkData"
+	StateParseChunkEnd parserState = "parsingChunkEnd"
+	StateParseTrailers parserState = "parsingTrailers"
 	StateDone parserState = "done"
 )
 
 type Request struct {
 	RequestLine RequestLine
-	Headers headers.Headers
+	// URL is RequestLine.RequestTarget taken apart
+	URL *URL
+	Headers *headers.Headers
 	Body []byte
+	// Trailers holds the fields sent after a chunked body
+	Trailers *headers.Headers
+	// BodyReader reads the body. For requests from ReadStreamingRequest it
+	// streams from the connection and Body stays empty, otherwise it reads
+	// from Body.
+	BodyReader io.ReadCloser
 
 	state parserState
+	chunkLeft int
+	bodyLen int
+	stream *bodyReader
+	limits Limits
+	headerBytes int
+	headerCount int
+	consumed int
+	form Values
+	multipartForm *MultipartForm
+	pathValues map[string]string
 }
 
 func (r* Request) String() string {
@@ -46,6 +70,7 @@ func newRequest() *Request {
 		state: StateInit,
 		Headers: headers.NewHeaders(),
 		Body: make([]byte, 0),
+		Trailers: headers.NewHeaders(),
 	}
 }
 
@@ -53,8 +78,44 @@ func (r *Request) done() bool {
 	return r.state == StateDone
 }
 
+// headersDone reports whether everything up to the body has been parsed
+func (r *Request) headersDone() bool {
+	return r.state != StateInit && r.state != StateParseHeaders
+}
+
+func (r *Request) appendBody(p []byte) {
+	r.bodyLen += len(p)
+	if r.stream != nil {
+		r.stream.buf = append(r.stream.buf, p...)
+		return
+	}
+	r.Body = append(r.Body, p...)
+}
+
+// checkFieldLimits accounts for one step of header or trailer parsing that
+// consumed n bytes out of the available ones
+func (r *Request) checkFieldLimits(n int, done bool, available int) error {
+	if n == 0 {
+		// the line isn't complete yet, but it may already be too long
+		if exceeds(r.headerBytes+available, r.limits.MaxHeaderBytes) {
+			return ErrHeadersTooLarge
+		}
+		return nil
+	}
+	r.headerBytes += n
+	if !done {
+		r.headerCount++
+	}
+	if exceeds(r.headerBytes, r.limits.MaxHeaderBytes) || exceeds(r.headerCount, r.limits.MaxHeaderCount) {
+		return ErrHeadersTooLarge
+	}
+	return nil
+}
+
 var REQ_LINE_SEP = []byte("\r\n")
 
+// parseRequestLine parses the request line at the start of rawReq. Errors are
+// *ParseError with offsets relative to rawReq.
 func parseRequestLine(rawReq []byte) (*RequestLine, int, error) {
 	allLetter := regexp.MustCompile(`^[a-zA-Z]+$`).MatchString
 	idx := bytes.Index(rawReq, REQ_LINE_SEP)
@@ -67,35 +128,49 @@ func parseRequestLine(rawReq []byte) (*RequestLine, int, error) {
 
 	fields := bytes.Split(startLine, []byte(" "))
 	if size := len(fields); size != 3 {
-		return nil, 0, fmt.Errorf("bad number of fields. expected 3, got %d", size)
+		return nil, 0, newParseError(ErrMalformedRequestLine, 0, fmt.Errorf("expected 3 fields, got %d", size))
 	}
 
-	httpParts := bytes.Split(fields[2], []byte("/"))
-	if size := len(httpParts); size != 2 {
-		return nil, 0, fmt.Errorf("bad HTTP version")
-	}
-	httpV := string(httpParts[1])
-
-	if httpV != "1.1" {
-		return nil, 0, fmt.Errorf("HTTP version must be '1.1', got '%s'", httpV)
-	}
-	if string(httpParts[0]) != "HTTP" {
-		return nil, 0, fmt.Errorf("HTTP version must be 'HTTP', got '%s'", httpParts[0])
+	method := string(fields[0])
+	if !allLetter(method) {
+		return nil, 0, newParseError(ErrInvalidMethod, 0, fmt.Errorf("method must be all letters, got %q", method))
 	}
 
 	reqTarget := string(fields[1])
+	if len(reqTarget) == 0 {
+		return nil, 0, newParseError(ErrMalformedRequestLine, len(method)+1, fmt.Errorf("empty request target"))
+	}
 
-	method := string(fields[0])
-	if !allLetter(method) {
-		return nil, 0, fmt.Errorf("method must be all letters. got %s", method)
+	versionOffset := len(method) + len(reqTarget) + 2
+	httpParts := bytes.Split(fields[2], []byte("/"))
+	if size := len(httpParts); size != 2 || string(httpParts[0]) != "HTTP" {
+		return nil, 0, newParseError(ErrMalformedRequestLine, versionOffset, fmt.Errorf("bad HTTP version %q", fields[2]))
+	}
+	httpV := string(httpParts[1])
+	if !regexp.MustCompile(`^[0-9]\.[0-9]$`).MatchString(httpV) {
+		return nil, 0, newParseError(ErrMalformedRequestLine, versionOffset, fmt.Errorf("bad HTTP version %q", fields[2]))
+	}
+	if httpV != "1.1" && httpV != "1.0" {
+		return nil, 0, newParseError(ErrUnsupportedVersion, versionOffset, fmt.Errorf("HTTP version must be '1.0' or '1.1', got '%s'", httpV))
 	}
 
 	return &RequestLine{httpV, reqTarget, method}, read, nil
 }
 
+// parse consumes as much of data as it can and returns how many bytes it
+// used. Errors are always *ParseError.
 func (r *Request) parse(data []byte) (int, error) {
 	read := 0
-	// fmt.Printf("%s\n", string(data))
+	defer func() { r.consumed += read }()
+	fail := func(err error) (int, error) {
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			perr = newParseError(err, 0, nil)
+		}
+		perr.Offset += r.consumed + read
+		read = 0
+		return 0, perr
+	}
 outer:
 	for {
 		if len(data) == 0 {
@@ -103,20 +178,45 @@ outer:
 		}
 		switch r.state {
 		case StateInit:
+			if err := checkBareLF(data[read:]); err != nil {
+				return fail(err)
+			}
 			rl, n, err := parseRequestLine(data[read:])
 			if err != nil {
-				return 0, err
+				return fail(err)
 			}
 			if n == 0 {
+				if exceeds(len(data[read:]), r.limits.MaxRequestLineBytes) {
+					return fail(ErrRequestLineTooLong)
+				}
 				break outer
 			}
+			if exceeds(n-len(REQ_LINE_SEP), r.limits.MaxRequestLineBytes) {
+				return fail(ErrRequestLineTooLong)
+			}
+			u, err := parseTarget(rl.Method, rl.RequestTarget)
+			if err != nil {
+				return fail(newParseError(ErrInvalidTarget, len(rl.Method)+1, err))
+			}
 			r.RequestLine = *rl
+			r.URL = u
 			read += n
 			r.state = StateParseHeaders
 		case StateParseHeaders:
+			if err := checkBareLF(data[read:]); err != nil {
+				return fail(err)
+			}
+			if r.Headers.Len() == 0 && len(data) > read && (data[read] == ' ' || data[read] == '\t') {
+				// RFC 9112 section 2.2: a proxy might ignore this line or
+				// read it as a field, so it can't be trusted either way
+				return fail(ErrLeadingWhitespace)
+			}
 			n, done, err := r.Headers.Parse(data[read:])
 			if err != nil {
-				return 0, err
+				return fail(newParseError(ErrMalformedHeader, 0, err))
+			}
+			if err := r.checkFieldLimits(n, done, len(data[read:])); err != nil {
+				return fail(err)
 			}
 			if n == 0 {
 				break outer
@@ -126,64 +226,180 @@ outer:
 				r.state = StateParseBody
 			}
 		case StateParseBody:
-			expecLenS, ok := r.Headers.Get("content-length")
-			if !ok {
+			chunked, expecLen, err := r.bodyFraming()
+			if err != nil {
+				return fail(err)
+			}
+			if chunked {
+				r.state = StateParseChunkSize
+				continue
+			}
+			if expecLen < 0 {
 				r.state = StateDone
 				break outer
 			}
-			expecLen, err := strconv.Atoi(expecLenS)
-			if err != nil {
-				return 0, fmt.Errorf("unknown content-length value: %v", expecLenS)
-			}
 			if expecLen == 0 {
 				r.state = StateDone
 				break outer
 			}
+			if exceeds(expecLen, r.limits.MaxBodyBytes) {
+				return fail(ErrBodyTooLarge)
+			}
 
-			r.Body = append(r.Body, data[read:]...)
-
-			read += len(data[read:])
-			if len(r.Body) > expecLen {
-				return 0, fmt.Errorf("too many bytes in body")
+			// only take what the body needs, anything after it belongs to the
+			// next request on the connection
+			remaining := expecLen - r.bodyLen
+			chunk := data[read:]
+			if len(chunk) > remaining {
+				chunk = chunk[:remaining]
 			}
+			r.appendBody(chunk)
+			read += len(chunk)
 
-			if len(r.Body) == expecLen {
+			if r.bodyLen == expecLen {
 				r.state = StateDone
 			}
 			return read, nil
+		case StateParseChunkSize:
+			if err := checkBareLF(data[read:]); err != nil {
+				return fail(err)
+			}
+			size, n, err := parseChunkSize(data[read:])
+			if err != nil {
+				return fail(newParseError(ErrMalformedChunk, 0, err))
+			}
+			if n == 0 {
+				if len(data[read:]) > maxChunkLineBytes {
+					return fail(newParseError(ErrMalformedChunk, 0, fmt.Errorf("chunk size line too long")))
+				}
+				break outer
+			}
+			if exceeds(r.bodyLen+size, r.limits.MaxBodyBytes) {
+				return fail(ErrBodyTooLarge)
+			}
+			read += n
+			r.chunkLeft = size
+			if size == 0 {
+				r.state = StateParseTrailers
+			} else {
+				r.state = StateParseChunkData
+			}
+		case StateParseChunkData:
+			chunk := data[read:]
+			if len(chunk) == 0 {
+				break outer
+			}
+			if len(chunk) > r.chunkLeft {
+				chunk = chunk[:r.chunkLeft]
+			}
+			r.appendBody(chunk)
+			read += len(chunk)
+			r.chunkLeft -= len(chunk)
+			if r.chunkLeft == 0 {
+				r.state = StateParseChunkEnd
+			}
+		case StateParseChunkEnd:
+			if len(data[read:]) < len(REQ_LINE_SEP) {
+				break outer
+			}
+			if !bytes.HasPrefix(data[read:], REQ_LINE_SEP) {
+				return fail(newParseError(ErrMalformedChunk, 0, fmt.Errorf("chunk data is not followed by CRLF")))
+			}
+			read += len(REQ_LINE_SEP)
+			r.state = StateParseChunkSize
+		case StateParseTrailers:
+			if err := checkBareLF(data[read:]); err != nil {
+				return fail(err)
+			}
+			n, done, err := r.Trailers.Parse(data[read:])
+			if err != nil {
+				return fail(newParseError(ErrMalformedTrailer, 0, err))
+			}
+			if err := r.checkFieldLimits(n, done, len(data[read:])); err != nil {
+				return fail(err)
+			}
+			if n == 0 {
+				break outer
+			}
+			read += n
+			if done {
+				r.state = StateDone
+			}
 		case StateDone:
 			break outer
 		default:
-			panic("uh oh")
+			return fail(newParseError(ErrParserState, 0, fmt.Errorf("%q", r.state)))
 		}
 	}
 	return read, nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	req := newRequest()
-	buf := make([]byte, 1024)
-	bufLen := 0
-	for !req.done() {
-		if bufLen >= len(buf) {
-			newBuf := make([]byte, 2*len(buf))
-			copy(newBuf, buf)
-			buf = newBuf
+// Cookies returns every cookie sent in the Cookie header
+func (r *Request) Cookies() []*cookie.Cookie {
+	val, ok := r.Headers.Get("Cookie")
+	if !ok {
+		return []*cookie.Cookie{}
+	}
+	return cookie.Parse(val)
+}
 
+// Cookie returns the first cookie called name, or cookie.ErrNoCookie
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
 		}
-		nRead, err := reader.Read(buf[bufLen:])
-		//todo what to do with errors?
-		if err != nil {
-			return nil, err
-		}
-		bufLen += nRead
-		nParsed, err := req.parse(buf[:bufLen])
-		if err != nil {
-			return nil, err
-		}
-		copy(buf, buf[nParsed:bufLen])
-		bufLen -= nParsed
 	}
-	return req, nil
+	return nil, cookie.ErrNoCookie
+}
+
+// KeepAlive reports whether the client is willing to send another request on
+// the same connection after this one
+func (r *Request) KeepAlive() bool {
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("Connection", "keep-alive")
+	}
+	return !r.Headers.HasToken("Connection", "close")
+}
+
+// PathValue returns the value a router matched for the named parameter in
+// the route's pattern, or "" if there is none
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue records the value of a route parameter, for routers
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
 }
 
+// Host returns the host the request is for, without a port: the host of an
+// absolute-form target, or else the Host header
+func (r *Request) Host() string {
+	host := ""
+	if r.URL != nil {
+		host = r.URL.Host
+	}
+	if host == "" {
+		host, _ = r.Headers.Get("Host")
+	}
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and
+// is holding the body back until it gets a 100 Continue. HTTP/1.0 clients
+// can't ask for one.
+func (r *Request) ExpectsContinue() bool {
+	exp, ok := r.Headers.Get("Expect")
+	return ok && r.RequestLine.HttpVersion != "1.0" && strings.EqualFold(strings.TrimSpace(exp), "100-continue")
+}
+
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
@@ -3,7 +3,11 @@ package request
 import (
 	//"strings"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"github.com/peter-howell/httpfromtcp/internal/cookie"
+	"github.com/peter-howell/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -27,6 +31,11 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+func get(h *headers.Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
 func TestBody( t *testing.T) {
 	// Test: Standard Body
 	reader := &chunkReader{
@@ -88,9 +97,9 @@ func TestRequestHeader(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -100,7 +109,7 @@ func TestRequestHeader(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Headers)
+	assert.Equal(t, 0, r.Headers.Len())
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -118,7 +127,7 @@ func TestRequestHeader(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, duplicate:8080", r.Headers["host"])
+	assert.Equal(t, "localhost:42069, duplicate:8080", get(r.Headers, "host"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -128,8 +137,8 @@ func TestRequestHeader(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -175,3 +184,602 @@ func TestRequestLineParse(t *testing.T) {
 }
 
 
+
+func TestReaderMultipleRequests(t *testing.T) {
+	// Test: Two requests in one stream, second one starts in the same read as the first body
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 64,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.True(t, reader.Buffered() > 0)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+
+	// Test: Clean end of stream after the last request
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Stream ends part way through a request
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n\r\nGET /partial HTT",
+		numBytesPerRead: 3,
+	})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Connection header
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nConnection: Close\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"6;name=value;flag\r\nworld!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+	_, ok := r.Headers.Get("X-Checksum")
+	assert.False(t, ok)
+
+	// Test: Chunked body without trailers followed by another request
+	rr := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A; ext=\"quoted;value\"\r\n0123456789\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"GET /after HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+	assert.Equal(t, 0, r.Trailers.Len())
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/after", r.RequestLine.RequestTarget)
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Missing terminating chunk
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Content-Length body is read from the stream, not buffered
+	rr := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n" +
+			"GET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err := rr.ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	require.NoError(t, r.BodyReader.Close())
+	r, err = rr.ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Chunked body is decoded while streaming
+	r, err = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n1;ext\r\n \r\n6\r\nworld!\r\n0\r\nX-Sum: 1\r\n\r\n",
+		numBytesPerRead: 3,
+	}).ReadStreamingRequest()
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+	assert.Equal(t, "1", get(r.Trailers, "x-sum"))
+
+	// Test: Unread body is skipped before the next request
+	rr = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 2,
+	})
+	_, err = rr.ReadStreamingRequest()
+	require.NoError(t, err)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+
+	// Test: Body too big to drain on Close
+	big := make([]byte, maxDrain+10)
+	r, err = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: " + strconv.Itoa(len(big)) + "\r\n" +
+			"\r\n" +
+			string(big),
+		numBytesPerRead: 4096,
+	}).ReadStreamingRequest()
+	require.NoError(t, err)
+	require.ErrorIs(t, r.BodyReader.Close(), ErrBodyNotDrained)
+
+	// Test: Stream ends before the body does
+	r, err = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 20\r\n" +
+			"\r\n" +
+			"partial content",
+		numBytesPerRead: 3,
+	}).ReadStreamingRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        10,
+	}
+	read := func(data string) (*Request, error) {
+		rr := NewReader(&chunkReader{data: data, numBytesPerRead: 5})
+		rr.SetLimits(limits)
+		return rr.ReadRequest()
+	}
+
+	// Test: Within every limit
+	r, err := read("POST /ok HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\n0123456789")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+
+	// Test: Request line too long, with and without its CRLF received
+	_, err = read("GET /" + strings.Repeat("a", 40) + " HTTP/1.1\r\n\r\n")
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+	_, err = read("GET /" + strings.Repeat("a", 40))
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header section too large
+	_, err = read("GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("b", 80) + "\r\n\r\n")
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Too many header lines
+	_, err = read("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Content-Length over the body limit is rejected before the body
+	_, err = read("POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\n")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body growing past the limit
+	_, err = read("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n6\r\nworld!\r\n0\r\n\r\n")
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		err    error
+		status int
+		offset int
+	}{
+		{"missing method", "/coffee HTTP/1.1\r\n\r\n", ErrMalformedRequestLine, 400, 0},
+		{"bad method", "G3T / HTTP/1.1\r\n\r\n", ErrInvalidMethod, 400, 0},
+		{"not HTTP", "GET / HTPT/1.1\r\n\r\n", ErrMalformedRequestLine, 400, 6},
+		{"HTTP/2", "GET /coffee HTTP/2.0\r\n\r\n", ErrUnsupportedVersion, 505, 12},
+		{"header without colon", "GET / HTTP/1.1\r\nHost: a\r\nBroken\r\n\r\n", ErrMalformedHeader, 400, 25},
+		{"bad content-length", "POST / HTTP/1.1\r\nContent-Length: ten\r\n\r\n", ErrInvalidContentLength, 400, 40},
+		{"unknown transfer coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrUnsupportedTransferCoding, 501, 44},
+		{"bad chunk", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n", ErrMalformedChunk, 400, 52},
+		{"body too short", "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc", ErrBodyTooShort, 400, 42},
+		{"incomplete headers", "GET / HTTP/1.1\r\nHost: a", ErrIncompleteRequest, 400, 23},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := RequestFromReader(&chunkReader{data: tt.data, numBytesPerRead: 3})
+			require.ErrorIs(t, err, tt.err)
+			var perr *ParseError
+			require.ErrorAs(t, err, &perr)
+			assert.Equal(t, tt.status, perr.StatusCode)
+			assert.Equal(t, tt.offset, perr.Offset)
+		})
+	}
+
+	// Test: Header errors keep the headers package cause
+	_, err := RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost : a\r\n\r\n", numBytesPerRead: 3})
+	require.ErrorIs(t, err, ErrMalformedHeader)
+	require.ErrorIs(t, err, headers.ErrSpaceBeforeColon)
+
+	// Test: Folded header lines are rejected unless the reader is lenient
+	folded := "GET / HTTP/1.1\r\nHost: a\r\nX-Long: one\r\n two\r\n\r\n"
+	_, err = RequestFromReader(&chunkReader{data: folded, numBytesPerRead: 3})
+	require.ErrorIs(t, err, ErrMalformedHeader)
+	require.ErrorIs(t, err, headers.ErrObsFold)
+
+	reader := NewReader(&chunkReader{data: folded, numBytesPerRead: 3})
+	reader.SetLenient(true)
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "one two", get(r.Headers, "x-long"))
+
+	// Test: A broken parser state is a ParseError too
+	r = newRequest()
+	r.state = "bogus"
+	_, err = r.parse([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, ErrParserState)
+	var perr *ParseError
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, 500, perr.StatusCode)
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: HTTP/1.0 closes by default
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive on request
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 keeps alive by default
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Other versions are not supported
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/0.9\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestRequestTarget(t *testing.T) {
+	parse := func(line string) (*Request, error) {
+		return RequestFromReader(&chunkReader{data: line + "\r\nHost: localhost\r\n\r\n", numBytesPerRead: 5})
+	}
+
+	// Test: Origin-form with query
+	r, err := parse("GET /search/caf%C3%A9?q=hello+world&tag=a&tag=b%26c&empty HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, r.URL.Form)
+	assert.Equal(t, "/search/café", r.URL.Path)
+	assert.Equal(t, "/search/caf%C3%A9", r.URL.RawPath)
+	assert.Equal(t, "q=hello+world&tag=a&tag=b%26c&empty", r.URL.RawQuery)
+	assert.Equal(t, "hello world", r.URL.Query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, r.URL.Query["tag"])
+	assert.True(t, r.URL.Query.Has("empty"))
+
+	// Test: Absolute-form for proxies
+	r, err = parse("GET HTTP://example.com:8080/a/b?x=1 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.URL.Form)
+	assert.Equal(t, "http", r.URL.Scheme)
+	assert.Equal(t, "example.com:8080", r.URL.Host)
+	assert.Equal(t, "/a/b", r.URL.Path)
+	assert.Equal(t, "1", r.URL.Query.Get("x"))
+
+	r, err = parse("GET http://example.com HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.URL.Path)
+
+	// Test: Authority-form for CONNECT
+	r, err = parse("CONNECT example.com:443 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.URL.Form)
+	assert.Equal(t, "example.com:443", r.URL.Host)
+	_, err = parse("CONNECT example.com HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidTarget)
+
+	// Test: Asterisk-form only for OPTIONS
+	r, err = parse("OPTIONS * HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.URL.Form)
+	_, err = parse("GET * HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidTarget)
+
+	// Test: Rejected targets
+	for _, target := range []string{"/page#section", "/bad%2", "/bad%zz", "/quote\"", "relative/path", "http://:80/", "/?q=%"} {
+		_, err = parse("GET " + target + " HTTP/1.1")
+		require.ErrorIs(t, err, ErrInvalidTarget, target)
+	}
+
+	// Test: Path normalization
+	r, err = parse("GET /a/./b/../../c//d/ HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "/a/./b/../../c//d/", r.URL.Path)
+	assert.Equal(t, "/c/d/", r.URL.NormalizedPath())
+	r, err = parse("GET /../../etc/passwd HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/passwd", r.URL.NormalizedPath())
+}
+
+func TestForms(t *testing.T) {
+	// Test: URL-encoded form from a buffered body
+	body := "name=Ada+Lovelace&lang=go&lang=c%2B%2B"
+	r, err := RequestFromReader(&chunkReader{
+		data: "POST /form HTTP/1.1\r\n" +
+			"Content-Type: application/x-www-form-urlencoded; charset=utf-8\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	form, err := r.ParseForm(DefaultFormLimits())
+	require.NoError(t, err)
+	assert.Equal(t, "Ada Lovelace", form.Get("name"))
+	assert.Equal(t, []string{"go", "c++"}, form["lang"])
+	again, err := r.ParseForm(DefaultFormLimits())
+	require.NoError(t, err)
+	assert.Equal(t, form, again)
+
+	// Test: Wrong content type
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST /form HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 3\r\n\r\na=b",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	_, err = r.ParseForm(DefaultFormLimits())
+	require.ErrorIs(t, err, ErrNotForm)
+
+	// Test: URL-encoded form over the limit
+	r, err = RequestFromReader(&chunkReader{
+		data: "POST /form HTTP/1.1\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	_, err = r.ParseForm(FormLimits{MaxBytes: 10})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+
+	// Test: Multipart form from a streamed chunked body, with one file spilled to disk
+	big := strings.Repeat("x", 100)
+	mp := "--XYZ\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+		"hello\r\n" +
+		"--XYZ\r\n" +
+		"Content-Disposition: form-data; name=\"small\"; filename=\"../../a.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"tiny\r\n" +
+		"--XYZ\r\n" +
+		"Content-Disposition: form-data; name=\"big\"; filename=\"b.txt\"\r\n\r\n" +
+		big + "\r\n" +
+		"--XYZ--\r\n"
+	r, err = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Type: multipart/form-data; boundary=XYZ\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			strconv.FormatInt(int64(len(mp)), 16) + "\r\n" + mp + "\r\n0\r\n\r\n",
+		numBytesPerRead: 11,
+	}).ReadStreamingRequest()
+	require.NoError(t, err)
+	mform, err := r.ParseMultipartForm(FormLimits{MaxBytes: 4096, MaxParts: 10, MaxMemory: 50})
+	require.NoError(t, err)
+	defer mform.RemoveAll()
+	assert.Equal(t, "hello", mform.Value.Get("title"))
+
+	small := mform.File["small"][0]
+	assert.Equal(t, "a.txt", small.Filename)
+	assert.Equal(t, int64(4), small.Size)
+	assert.Equal(t, "text/plain", get(small.Header, "content-type"))
+	f, err := small.Open()
+	require.NoError(t, err)
+	content, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "tiny", string(content))
+
+	bigFile := mform.File["big"][0]
+	assert.Equal(t, int64(100), bigFile.Size)
+	assert.NotEmpty(t, bigFile.tmpfile)
+	f, err = bigFile.Open()
+	require.NoError(t, err)
+	content, _ = io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, big, string(content))
+	require.NoError(t, mform.RemoveAll())
+
+	// Test: Part and size limits
+	multipartRequest := func() *Request {
+		r, err := RequestFromReader(&chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Content-Type: multipart/form-data; boundary=XYZ\r\n" +
+				"Content-Length: " + strconv.Itoa(len(mp)) + "\r\n" +
+				"\r\n" + mp,
+			numBytesPerRead: 64,
+		})
+		require.NoError(t, err)
+		return r
+	}
+	_, err = multipartRequest().ParseMultipartForm(FormLimits{MaxParts: 2})
+	require.ErrorIs(t, err, ErrTooManyParts)
+	_, err = multipartRequest().ParseMultipartForm(FormLimits{MaxBytes: 100})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+}
+
+func TestCookies(t *testing.T) {
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nCookie: session=abc123; theme=dark\r\nCookie: lang=en\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Len(t, r.Cookies(), 3)
+	c, err := r.Cookie("lang")
+	require.NoError(t, err)
+	assert.Equal(t, "en", c.Value)
+	_, err = r.Cookie("missing")
+	require.ErrorIs(t, err, cookie.ErrNoCookie)
+}
+
+func TestSmuggling(t *testing.T) {
+	// Test: Known smuggling payloads are rejected instead of being framed
+	// one way or the other
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"CL.TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED", ErrContentLengthWithTransferEncoding},
+		{"TE.CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n", ErrContentLengthWithTransferEncoding},
+		{"duplicate CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", ErrConflictingContentLength},
+		{"CL list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 6\r\n\r\nhello!", ErrConflictingContentLength},
+		{"signed CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello", ErrInvalidContentLength},
+		{"negative CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", ErrInvalidContentLength},
+		{"obfuscated TE", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", ErrUnsupportedTransferCoding},
+		{"TE with identity", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"doubled TE lines", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"chunked twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"empty TE", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: \r\n\r\n", ErrInvalidTransferEncoding},
+		{"space before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", headers.ErrSpaceBeforeColon},
+		{"folded TE", "POST / HTTP/1.1\r\nHost: a\r\nX: y\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", headers.ErrObsFold},
+		{"indented first TE", "POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\nHost: x\r\n\r\n0\r\n\r\n", ErrLeadingWhitespace},
+		{"tab before first field", "POST / HTTP/1.1\r\n\tHost: x\r\n\r\n", ErrLeadingWhitespace},
+		{"TE in HTTP/1.0", "POST / HTTP/1.0\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferEncoding},
+		{"bare LF in request line", "GET / HTTP/1.1\nHost: a\r\n\r\n", ErrBareLF},
+		{"bare LF in headers", "POST / HTTP/1.1\r\nHost: a\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrBareLF},
+		{"bare LF ending headers", "GET / HTTP/1.1\r\nHost: a\r\n\n", ErrBareLF},
+		{"bare LF in chunk size", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\n\r\n", ErrBareLF},
+		{"bare LF in trailers", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX: y\n\r\n", ErrBareLF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewReader(&chunkReader{data: tt.data + "GET /next HTTP/1.1\r\n\r\n", numBytesPerRead: 3})
+			_, err := reader.ReadRequest()
+			require.ErrorIs(t, err, tt.err)
+			var perr *ParseError
+			require.ErrorAs(t, err, &perr)
+			assert.Contains(t, []int{400, 501}, perr.StatusCode)
+
+			// nothing after a rejected request is ever parsed
+			_, err = reader.ReadRequest()
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	// Test: Repeated identical Content-Length values are fine
+	r, err := RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5, 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Chunked is matched case-insensitively
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+}
+
+func TestExpectContinue(t *testing.T) {
+	// Test: Expect: 100-continue on HTTP/1.1
+	reader := NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nExpect: 100-Continue\r\nContent-Length: 5\r\n\r\nhelloGET / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err := reader.ReadStreamingRequest()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+
+	// Test: BufferBody reads the rest of a streamed body
+	require.NoError(t, reader.BufferBody(r))
+	assert.Equal(t, "hello", string(r.Body))
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: HTTP/1.0 clients can't expect anything
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+}
@@ -0,0 +1,290 @@
+package request
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TargetForm is one of the four request-target forms from RFC 9112 section 3.2
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query, "/where?q=now"
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, sent to proxies, "http://example.com/where"
+	AbsoluteForm
+	// AuthorityForm is host and port, only used by CONNECT, "example.com:443"
+	AuthorityForm
+	// AsteriskForm is "*", only used by a server-wide OPTIONS
+	AsteriskForm
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case OriginForm:
+		return "origin-form"
+	case AbsoluteForm:
+		return "absolute-form"
+	case AuthorityForm:
+		return "authority-form"
+	case AsteriskForm:
+		return "asterisk-form"
+	default:
+		return fmt.Sprintf("TargetForm(%d)", int(f))
+	}
+}
+
+// URL is the parsed request target
+type URL struct {
+	Form TargetForm
+	// Scheme is only set for the absolute-form
+	Scheme string
+	// Host is host[:port] for the absolute- and authority-forms
+	Host string
+	// Path is the percent-decoded path, RawPath is the path as it was sent
+	Path    string
+	RawPath string
+	// RawQuery is the query without its "?", still encoded
+	RawQuery string
+	// Query holds the decoded query parameters
+	Query Values
+}
+
+// NormalizedPath returns Path with "." and ".." segments resolved and
+// repeated slashes collapsed. A trailing slash is kept.
+func (u *URL) NormalizedPath() string {
+	if u.Path == "" {
+		return ""
+	}
+	clean := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+func (u *URL) String() string {
+	switch u.Form {
+	case AsteriskForm:
+		return "*"
+	case AuthorityForm:
+		return u.Host
+	}
+	s := u.RawPath
+	if u.Form == AbsoluteForm {
+		s = u.Scheme + "://" + u.Host + s
+	}
+	if u.RawQuery != "" {
+		s += "?" + u.RawQuery
+	}
+	return s
+}
+
+// parseTarget works out the form of target and splits it into its parts.
+// Which forms are allowed depends on the method.
+func parseTarget(method, target string) (*URL, error) {
+	if strings.IndexByte(target, '#') != -1 {
+		return nil, fmt.Errorf("request target can't have a fragment")
+	}
+	if err := checkTargetChars(target); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("asterisk-form is only allowed for OPTIONS")
+		}
+		return &URL{Form: AsteriskForm, Query: Values{}}, nil
+	case method == "CONNECT":
+		if err := checkAuthority(target, true); err != nil {
+			return nil, err
+		}
+		return &URL{Form: AuthorityForm, Host: target, Query: Values{}}, nil
+	case strings.HasPrefix(target, "/"):
+		u := &URL{Form: OriginForm}
+		return u, u.setPathAndQuery(target)
+	}
+
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !validScheme(scheme) {
+		return nil, fmt.Errorf("request target %q is not in any known form", target)
+	}
+	host, pathAndQuery := rest, ""
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		host, pathAndQuery = rest[:i], rest[i:]
+	}
+	if err := checkAuthority(host, false); err != nil {
+		return nil, err
+	}
+	u := &URL{
+		Form:   AbsoluteForm,
+		Scheme: strings.ToLower(scheme),
+		Host:   host,
+	}
+	if err := u.setPathAndQuery(pathAndQuery); err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", "/"
+	}
+	return u, nil
+}
+
+func (u *URL) setPathAndQuery(s string) error {
+	rawPath, rawQuery, _ := strings.Cut(s, "?")
+	p, err := unescape(rawPath, false)
+	if err != nil {
+		return err
+	}
+	query, err := ParseQuery(rawQuery)
+	if err != nil {
+		return err
+	}
+	u.Path, u.RawPath = p, rawPath
+	u.RawQuery, u.Query = rawQuery, query
+	return nil
+}
+
+// checkTargetChars makes sure every byte is allowed somewhere in a URI and
+// every '%' starts a valid escape
+func checkTargetChars(s string) error {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+				return fmt.Errorf("invalid percent-encoding in %q", s)
+			}
+			i += 2
+		case isUnreserved(c) || strings.IndexByte("!$&'()*+,;=:@/?[]", c) != -1:
+		default:
+			return fmt.Errorf("invalid character %q in request target", c)
+		}
+	}
+	return nil
+}
+
+// checkAuthority checks host[:port]. CONNECT targets must carry a port.
+func checkAuthority(s string, needPort bool) error {
+	if s == "" {
+		return fmt.Errorf("missing host")
+	}
+	if strings.ContainsAny(s, "@/?") {
+		return fmt.Errorf("invalid authority %q", s)
+	}
+	host, port := s, ""
+	if i := strings.LastIndexByte(s, ':'); i != -1 && !strings.HasSuffix(s, "]") {
+		host, port = s[:i], s[i+1:]
+		for j := 0; j < len(port); j++ {
+			if port[j] < '0' || port[j] > '9' {
+				return fmt.Errorf("invalid port in %q", s)
+			}
+		}
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", s)
+	}
+	if needPort && port == "" {
+		return fmt.Errorf("authority-form %q needs a port", s)
+	}
+	return nil
+}
+
+func validScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !('0' <= c && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isUnreserved(c byte) bool {
+	return isAlpha(c) || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// unescape decodes percent-encoding, and '+' as a space when plusIsSpace is
+// set (as in query strings and form bodies)
+func unescape(s string, plusIsSpace bool) (string, error) {
+	if strings.IndexByte(s, '%') == -1 && (!plusIsSpace || strings.IndexByte(s, '+') == -1) {
+		return s, nil
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+				return "", fmt.Errorf("invalid percent-encoding in %q", s)
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c == '+' && plusIsSpace:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// Values maps a query or form parameter name to its values, in the order they
+// were sent
+type Values map[string][]string
+
+// Get returns the first value for key, or "" if there is none
+func (v Values) Get(key string) string {
+	if vals := v[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// ParseQuery decodes a "a=1&b=2" query string or form body
+func ParseQuery(query string) (Values, error) {
+	v := Values{}
+	for query != "" {
+		var pair string
+		pair, query, _ = strings.Cut(query, "&")
+		if pair == "" {
+			continue
+		}
+		rawKey, rawVal, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return nil, err
+		}
+		val, err := unescape(rawVal, true)
+		if err != nil {
+			return nil, err
+		}
+		v[key] = append(v[key], val)
+	}
+	return v, nil
+}
@@ -0,0 +1,28 @@
+package response
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+)
+
+type cachedDate struct {
+	unix int64
+	val  string
+}
+
+var lastDate atomic.Pointer[cachedDate]
+
+// Date returns the current time formatted for the Date header. Dates only
+// have a resolution of one second, so the string is built once per second
+// and shared.
+func Date() string {
+	now := time.Now()
+	if d := lastDate.Load(); d != nil && d.unix == now.Unix() {
+		return d.val
+	}
+	d := &cachedDate{unix: now.Unix(), val: now.UTC().Format(headers.TimeFormat)}
+	lastDate.Store(d)
+	return d.val
+}
@@ -2,13 +2,44 @@
 package response
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
 
+	"github.com/peter-howell/httpfromtcp/internal/cookie"
 	"github.com/peter-howell/httpfromtcp/internal/headers"
 )
 
 
+// ErrBodyNotAllowed is returned when writing content in a response whose
+// status doesn't allow a body, such as 204 or 304
+var ErrBodyNotAllowed = errors.New("response status does not allow a body")
+
+// ErrContentLengthExceeded is returned by Write when the body would run past
+// the declared Content-Length
+var ErrContentLengthExceeded = errors.New("body longer than the declared content-length")
+
+// Flusher is implemented by writers that can send buffered data right away,
+// like Writer
+type Flusher interface {
+	Flush() error
+}
+
+var (
+	_ io.Writer       = (*Writer)(nil)
+	_ io.StringWriter = (*Writer)(nil)
+	_ io.ReaderFrom   = (*Writer)(nil)
+	_ Flusher         = (*Writer)(nil)
+)
+
+// DefaultBufferSize is how much of a body without declared framing is held
+// back to send with a Content-Length before the writer switches to chunked
+// encoding
+const DefaultBufferSize = 8 << 10
+
 type writerState int 
 const (
 	wStateStatusLine writerState = iota
@@ -20,33 +51,77 @@ const (
 type Writer struct {
 	wState writerState
 	writer io.Writer
-}
+	status StatusCode
 
-type StatusCode int
-const (
-	StatusOK StatusCode = 200
-	StatusBadRequest StatusCode = 400
-	StatusInternalServerError StatusCode = 500
-)
+	keepAlive     bool
+	chunked       bool
+	contentLength int // -1 when the headers didn't declare one
+	bodyWritten   int
+	done          bool
+
+	// HTTP/1.0 clients don't understand chunked encoding, so up to
+	// bufferSize bytes of a chunked response to one are collected in buf and
+	// sent with a Content-Length. A longer body is sent unframed.
+	http10   bool
+	buffered *headers.Headers
+	buf      bytes.Buffer
+
+	// auto is set while the writer holds back headers that declared no
+	// framing, collecting up to bufferSize bytes of body in buf to send with
+	// a Content-Length
+	auto       bool
+	bufferSize int
 
+	cookies []*cookie.Cookie
 
+	preserveCase bool
+
+	// trailers are the declared trailer field names
+	trailers []string
+
+	sendDate   bool
+	serverName string
+
+	// head is set for responses to HEAD requests. Their body is counted
+	// but never sent, headLen is the count while the headers are held back.
+	head    bool
+	headLen int
+
+	// header is what was passed to WriteHeaders and written is how many
+	// body bytes the handler has written, for middleware to look at
+	header  *headers.Headers
+	written int64
+
+	// err is set once a header section couldn't be written. The client got
+	// at most part of the response, so nothing more can be sent on the
+	// connection.
+	err error
+}
+
+// GetStatusLine returns the status line for code with its registered reason
+// phrase. A code that isn't registered gets an empty reason phrase.
 func GetStatusLine(code StatusCode) ([]byte, error) {
-	var line = []byte{}
-	switch code {
-	case StatusOK:
-		line = []byte("HTTP/1.1 200 OK")
-	case StatusBadRequest:
-		line = []byte("HTTP/1.1 400 Bad Request")
-	case StatusInternalServerError:
-		line = []byte("HTTP/1.1 500 Internal Server Error")
-	default:
-		return nil, fmt.Errorf("unknown status code %v", code)
+	return GetStatusLineReason(code, StatusText(code))
+}
+
+// GetStatusLineReason returns the status line for code with a custom reason
+// phrase
+func GetStatusLineReason(code StatusCode, reason string) ([]byte, error) {
+	if !code.Valid() {
+		return nil, fmt.Errorf("invalid status code %d", int(code))
 	}
-	return line, nil
+	if !headers.ValidValue(reason) {
+		return nil, fmt.Errorf("invalid reason phrase %q", reason)
+	}
+	return fmt.Appendf(nil, "HTTP/1.1 %03d %s", int(code), reason), nil
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	line, err := GetStatusLine(statusCode)
+	return writeStatusLine(w, statusCode, StatusText(statusCode))
+}
+
+func writeStatusLine(w io.Writer, statusCode StatusCode, reason string) error {
+	line, err := GetStatusLineReason(statusCode, reason)
 	if err != nil {
 		return err
 	}
@@ -54,17 +129,16 @@ func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
 	return err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 
 	return h
 }
 
-func WriteHeaders(w io.Writer, h headers.Headers) error {
+func WriteHeaders(w io.Writer, h *headers.Headers) error {
 	err := h.Write(w)
 	if err != nil {
 		return err
@@ -76,38 +150,547 @@ func WriteHeaders(w io.Writer, h headers.Headers) error {
 
 func NewWriter(conn io.Writer) *Writer {
 	return &Writer{
-		wState: wStateStatusLine,
-		writer: conn,
+		wState:        wStateStatusLine,
+		writer:        conn,
+		contentLength: -1,
+		bufferSize:    DefaultBufferSize,
+	}
+}
+
+// SetBufferSize changes how much of a body without declared framing is held
+// back before the writer switches to chunked encoding. The same limit applies
+// to chunked bodies held back for HTTP/1.0 clients. It must be called before
+// the body is written.
+func (w *Writer) SetBufferSize(n int) {
+	w.bufferSize = n
+}
+
+// SetKeepAlive tells the writer whether the server intends to reuse the
+// connection after this response. It must be called before WriteHeaders.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetCookie adds a Set-Cookie line to the response. Each cookie gets its own
+// line since cookie attributes can't be joined with commas. It must be called
+// before WriteHeaders.
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if w.wState != wStateStatusLine && w.wState != wStateHeaders {
+		return fmt.Errorf("cookies must be set before the headers are written")
+	}
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c)
+	return nil
+}
+
+// SetPreserveHeaderCase stops the writer from canonicalizing field names, so
+// headers and trailers go out with exactly the casing they were set with
+func (w *Writer) SetPreserveHeaderCase(preserve bool) {
+	w.preserveCase = preserve
+}
+
+// SetSendDate makes the writer add a Date header, unless the handler set
+// one. It must be called before WriteHeaders.
+func (w *Writer) SetSendDate(send bool) {
+	w.sendDate = send
+}
+
+// SetServerName makes the writer add a Server header with name, unless the
+// handler set one. It must be called before WriteHeaders.
+func (w *Writer) SetServerName(name string) {
+	w.serverName = name
+}
+
+// SetRequestMethod tells the writer which method the request used. For HEAD
+// the headers go out as they would for GET, Content-Length included, but the
+// body is discarded, so handlers don't need to treat HEAD differently. It
+// must be called before WriteHeaders.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// SetPeerVersion tells the writer which HTTP version the client spoke, such
+// as "1.0" or "1.1". It must be called before WriteHeaders.
+func (w *Writer) SetPeerVersion(version string) {
+	w.http10 = version == "1.0"
+}
+
+// KeepAlive reports whether the connection can carry another response: the
+// server asked for it, the handler didn't opt out with "Connection: close",
+// and the response was completely written with a framed body.
+func (w *Writer) KeepAlive() bool {
+	if !w.keepAlive || w.err != nil || w.wState == wStateStatusLine || w.wState == wStateHeaders {
+		return false
 	}
+	if w.head {
+		// the message ends with the headers
+		return w.buffered == nil
+	}
+	if w.chunked {
+		return w.done
+	}
+	return w.bodyWritten == w.contentLength
+}
+
+// WriteInformational sends an interim 1xx response, such as 100 Continue or
+// 103 Early Hints with Link headers, ahead of the final status line. It can
+// be called any number of times before WriteStatusLine. HTTP/1.0 clients
+// don't understand interim responses, so nothing is sent to them.
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
+	if w.wState != wStateStatusLine {
+		return fmt.Errorf("interim responses must come before the status line")
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == 101 {
+		return fmt.Errorf("%d is not an interim status code", statusCode)
+	}
+	if w.http10 {
+		return nil
+	}
+	if err := WriteStatusLine(w.writer, statusCode); err != nil {
+		return err
+	}
+	if h != nil {
+		if !w.preserveCase {
+			h.Canonicalize()
+		}
+		if err := h.WriteFields(w.writer); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w.writer, "\r\n")
+	return err
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineReason writes the status line with a custom reason phrase.
+// Interim 1xx codes go through WriteInformational instead.
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reason string) error {
 	if w.wState != wStateStatusLine  {
 		fmt.Printf("current state is %v, but it should be %v", w.wState, wStateStatusLine)
 		return fmt.Errorf("status line is not needed based on current state")
 	}
-	defer func() {w.wState = wStateHeaders}()
-	err := WriteStatusLine(w.writer, statusCode)
+	if statusCode.IsInformational() {
+		return fmt.Errorf("%d is an interim status, use WriteInformational", statusCode)
+	}
+	if err := writeStatusLine(w.writer, statusCode, reason); err != nil {
+		return err
+	}
+	w.status = statusCode
+	w.wState = wStateHeaders
+	return nil
+}
 
-	return err
+// Status returns the status code written so far, or 0 before WriteStatusLine
+func (w *Writer) Status() StatusCode {
+	return w.status
 }
 
-func (w *Writer) WriteHeaders(h headers.Headers) error {
+// Headers returns the header fields passed to WriteHeaders, or nil before
+// the headers were written. A handler that only called Write gets an empty
+// set. Fields the writer adds, such as Date, Server and the framing it picks,
+// only show up once the header section was sent, which for a held back body
+// happens in Finish.
+func (w *Writer) Headers() *headers.Headers {
+	return w.header
+}
+
+// Written returns how many bytes of body have been written so far, whether
+// they were sent yet or not. The bytes of a HEAD response's body are counted
+// too.
+func (w *Writer) Written() int64 {
+	return w.written
+}
+
+// WriteHeaders writes the header section, or holds it back until the body's
+// framing is known. If it fails the response can't be completed: every
+// later write fails and the connection is closed after it.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if w.err != nil {
+		return w.err
+	}
 	if w.wState != wStateHeaders {
 		return fmt.Errorf("headers aren't needed based on current state")
 	}
-	defer func() {w.wState = wStateBody}()
-	return WriteHeaders(w.writer, h)
+	if err := w.writeHeaders(h); err != nil {
+		w.err = err
+		return err
+	}
+	w.wState = wStateBody
+	return nil
+}
+
+func (w *Writer) writeHeaders(h *headers.Headers) error {
+	// the framing is parsed before anything about the writer changes
+	chunked := h.HasToken("Transfer-Encoding", "chunked")
+	contentLength := -1
+	if cl, ok := h.Get("Content-Length"); ok && !chunked && w.status.AllowsBody() {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid content-length %q", cl)
+		}
+		contentLength = n
+	}
+	if err := w.declareTrailers(h); err != nil {
+		return err
+	}
+	if err := h.Valid(); err != nil {
+		return err
+	}
+	w.header = h
+
+	if !w.status.AllowsBody() {
+		// there is no body to frame. A 304 may still carry the
+		// Content-Length a 200 would have had.
+		h.Del("Transfer-Encoding")
+		if w.status != StatusNotModified {
+			h.Del("Content-Length")
+		}
+		w.contentLength = 0
+		return w.writeHeaderSection(h)
+	}
+
+	w.chunked = chunked
+	w.contentLength = contentLength
+	if h.HasToken("Connection", "close") {
+		w.keepAlive = false
+	}
+	if !w.chunked && w.contentLength < 0 {
+		// the framing is picked once it's known how big the body is
+		w.auto = true
+		w.buffered = h
+		return nil
+	}
+	if w.chunked && w.http10 {
+		h.Del("Transfer-Encoding")
+		w.buffered = h
+		return nil
+	}
+	return w.writeHeaderSection(h)
+}
+
+func (w *Writer) writeHeaderSection(h *headers.Headers) (err error) {
+	defer func() {
+		if err != nil {
+			w.err = err
+		}
+	}()
+	if w.sendDate && !h.Has("Date") {
+		h.Set("Date", Date())
+	}
+	if w.serverName != "" && !h.Has("Server") {
+		h.Set("Server", w.serverName)
+	}
+	switch {
+	case !w.keepAlive:
+		h.Replace("Connection", "close")
+	case w.http10:
+		// 1.0 connections close unless told otherwise
+		h.Replace("Connection", "keep-alive")
+	}
+	if !w.preserveCase {
+		h.Canonicalize()
+	}
+	// the empty line is written even when there are no fields, since it is
+	// what ends the header section
+	if err := h.WriteFields(w.writer); err != nil {
+		return err
+	}
+	for _, c := range w.cookies {
+		if _, err := fmt.Fprintf(w.writer, "Set-Cookie: %s\r\n", c); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w.writer, "\r\n")
+	return err
+}
+
+// flushBuffered sends a response whose body was held back in buf, with a
+// Content-Length and any trailers merged into its headers
+func (w *Writer) flushBuffered(trailers *headers.Headers) error {
+	if err := w.checkTrailers(trailers); err != nil {
+		return err
+	}
+	h := w.buffered
+	w.buffered = nil
+	w.auto = false
+	// the trailers become plain header fields
+	h.Del("Trailer")
+	for key, val := range trailers.All() {
+		h.Add(key, val)
+	}
+	size := w.buf.Len()
+	if w.head {
+		size = w.headLen
+	}
+	if w.status.AllowsBody() {
+		h.Replace("Content-Length", strconv.Itoa(size))
+	}
+	w.chunked = false
+	w.contentLength = size
+	if err := w.writeHeaderSection(h); err != nil {
+		return err
+	}
+	n, err := w.buf.WriteTo(w.writer)
+	if !w.head {
+		w.bodyWritten = int(n)
+	}
+	w.done = err == nil
+	return err
+}
+
+// startStreaming gives up on sending a held back body with a
+// Content-Length. It switches to chunked encoding, or for HTTP/1.0 clients
+// sends the body unframed, without trailers, and closes the connection after
+// it.
+func (w *Writer) startStreaming() error {
+	h := w.buffered
+	w.buffered = nil
+	w.auto = false
+	if w.http10 {
+		w.keepAlive = false
+		w.chunked = false
+		h.Del("Trailer")
+	} else {
+		h.Replace("Transfer-Encoding", "chunked")
+		w.chunked = true
+	}
+	if err := w.writeHeaderSection(h); err != nil {
+		return err
+	}
+	body := w.buf.Bytes()
+	w.buf.Reset()
+	if len(body) == 0 {
+		return nil
+	}
+	// the body was counted when it was buffered
+	defer func(written int64) { w.written = written }(w.written)
+	var err error
+	if w.chunked {
+		_, err = w.WriteChunkedBody(body)
+	} else {
+		_, err = w.WriteBody(body)
+	}
+	return err
+}
+
+// Write writes p as part of the body. Before the status line or the headers
+// have been written it sends 200 OK and empty headers. When the headers
+// declared no framing, the body is collected and sent with a Content-Length
+// once the handler is done, or switched to chunked encoding once it grows
+// past the buffer size or Flush is called.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	switch w.wState {
+	case wStateStatusLine:
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return 0, err
+		}
+		fallthrough
+	case wStateHeaders:
+		if err := w.WriteHeaders(headers.NewHeaders()); err != nil {
+			return 0, err
+		}
+	case wStateTrailers:
+		return 0, fmt.Errorf("body isn't needed based on current state")
+	}
+	if !w.status.AllowsBody() && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.head {
+		return w.discard(len(p)), nil
+	}
+	if w.auto {
+		if w.buf.Len()+len(p) <= w.bufferSize {
+			w.written += int64(len(p))
+			return w.buf.Write(p)
+		}
+		if err := w.startStreaming(); err != nil {
+			return 0, err
+		}
+	}
+	if w.chunked {
+		// WriteChunkedBody counts the chunk framing too
+		if _, err := w.WriteChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.WriteBody(p)
+}
+
+func (w *Writer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// ReadFrom copies r into the body, so io.Copy(w, r) uses it. A file sent
+// without declared framing gets its size as the Content-Length. Unencoded
+// bodies are handed to the underlying writer's ReadFrom, which on a TCP
+// connection sends files with sendfile or splice instead of copying them
+// through user space.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.wState == wStateStatusLine || w.wState == wStateHeaders {
+		if _, err := w.Write(nil); err != nil {
+			return 0, err
+		}
+	}
+	if w.auto && w.buf.Len() == 0 && w.status.AllowsBody() {
+		if size, ok := remainingSize(r); ok {
+			w.buffered.Replace("Content-Length", strconv.FormatInt(size, 10))
+			w.contentLength = int(size)
+			h := w.buffered
+			w.buffered = nil
+			w.auto = false
+			if err := w.writeHeaderSection(h); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if w.head {
+		if w.contentLength >= 0 && !w.auto {
+			// the size is known, so there is no need to read anything
+			return 0, nil
+		}
+		return io.Copy(struct{ io.Writer }{w}, r)
+	}
+
+	rf, ok := w.writer.(io.ReaderFrom)
+	if !ok || w.wState != wStateBody || w.auto || w.chunked || w.buffered != nil || !w.status.AllowsBody() {
+		// struct{ io.Writer } hides this method so io.Copy doesn't come
+		// back here
+		return io.Copy(struct{ io.Writer }{w}, r)
+	}
+	if w.contentLength >= 0 {
+		r = &io.LimitedReader{R: r, N: int64(w.contentLength - w.bodyWritten)}
+	}
+	n, err := rf.ReadFrom(r)
+	w.bodyWritten += int(n)
+	w.written += n
+	return n, err
+}
+
+// discard counts n bytes of a HEAD response's body instead of sending them
+func (w *Writer) discard(n int) int {
+	w.written += int64(n)
+	if w.buffered != nil {
+		w.headLen += n
+	} else {
+		w.bodyWritten += n
+	}
+	return n
+}
+
+// remainingSize returns how much is left to read from r, if r is a regular
+// file
+func remainingSize(r io.Reader) (int64, bool) {
+	f, ok := r.(interface {
+		Stat() (os.FileInfo, error)
+		io.Seeker
+	})
+	if !ok {
+		return 0, false
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || offset > info.Size() {
+		return 0, false
+	}
+	return info.Size() - offset, true
+}
+
+// Flush sends a held back body right away, switching to chunked encoding
+// since its full length isn't known yet, and flushes the underlying writer
+// if it buffers
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.buffered != nil && w.wState == wStateBody {
+		if err := w.startStreaming(); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.writer.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Finish completes the response once the handler has returned: held back
+// headers and bodies are sent and a chunked body gets its last chunk. A
+// handler that wrote nothing gets 200 OK with an empty body. The server calls
+// it, handlers don't need to.
+func (w *Writer) Finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.wState == wStateStatusLine {
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+	}
+	if w.wState == wStateHeaders {
+		if err := w.WriteHeaders(headers.NewHeaders()); err != nil {
+			return err
+		}
+	}
+	if w.buffered != nil {
+		return w.flushBuffered(nil)
+	}
+	if w.chunked && w.wState == wStateBody {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	if w.chunked && w.wState == wStateTrailers && !w.done {
+		// end the message with an empty trailer section
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+	return nil
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
 	if w.wState != wStateBody {
 		return 0, fmt.Errorf("body isn't needed based on current state")
 	}
-	return w.writer.Write(p)
+	if !w.status.AllowsBody() && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.head {
+		return w.discard(len(p)), nil
+	}
+	if w.auto {
+		return w.Write(p)
+	}
+	if w.contentLength >= 0 && w.bodyWritten+len(p) > w.contentLength {
+		return 0, ErrContentLengthExceeded
+	}
+	n, err := w.writer.Write(p)
+	w.bodyWritten += n
+	w.written += int64(n)
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
 	if w.wState != wStateBody {
 		return 0, fmt.Errorf("body isn't needed based on current state")
 	}
@@ -118,6 +701,26 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if chunkLen <= 0 {
 		return 0, nil
 	}
+	if !w.status.AllowsBody() {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.head {
+		return w.discard(chunkLen), nil
+	}
+	if w.auto || !w.chunked {
+		// the headers didn't ask for chunked encoding
+		return w.Write(p)
+	}
+	if w.buffered != nil {
+		if w.buf.Len()+chunkLen <= w.bufferSize {
+			w.written += int64(chunkLen)
+			return w.buf.Write(p)
+		}
+		if err := w.startStreaming(); err != nil {
+			return 0, err
+		}
+		return w.WriteBody(p)
+	}
 
 	n, err := fmt.Fprintf(w.writer, "%X\r\n", chunkLen)
 	nTotal += n
@@ -126,21 +729,63 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return nTotal, err
 	}
 
-	toWrite := fmt.Appendf(p, "\r\n")
+	n, err = w.writer.Write(p)
+	nTotal += n
+	w.written += int64(n)
+	if err != nil {
+		return nTotal, err
+	}
 
-	n, err = w.writer.Write(toWrite)
+	n, err = w.writer.Write([]byte("\r\n"))
 
 	return nTotal + n, err
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
 	defer func() {w.wState = wStateTrailers}()
+	if w.buffered != nil || !w.chunked || w.head {
+		return 0, nil
+	}
 	return w.writer.Write([]byte("0\r\n"))
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// WriteTrailers ends a chunked message with the trailer section. Every field
+// must have been declared with DeclareTrailer or the Trailer header. h may be
+// empty, the message is properly ended either way.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if w.err != nil {
+		return w.err
+	}
 	if w.wState != wStateTrailers {
 		return fmt.Errorf("can't write trailers if state is %v", w.wState)
 	}
-	return h.Write(w.writer)
+	if w.buffered != nil {
+		return w.flushBuffered(h)
+	}
+	if !w.chunked {
+		// only chunked messages have a trailer section
+		return nil
+	}
+	if w.done {
+		return fmt.Errorf("trailers were already written")
+	}
+	if err := w.checkTrailers(h); err != nil {
+		return err
+	}
+	if w.head {
+		w.done = true
+		return nil
+	}
+	if !w.preserveCase {
+		h.Canonicalize()
+	}
+	if err := h.WriteFields(w.writer); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w.writer, "\r\n")
+	w.done = err == nil
+	return err
 }
@@ -0,0 +1,679 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peter-howell/httpfromtcp/internal/cookie"
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterHTTP10(t *testing.T) {
+	// Test: Chunked response to an HTTP/1.0 client is sent with a Content-Length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetPeerVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Content-Length")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Length", "11")
+	require.NoError(t, w.WriteTrailers(trailers))
+
+	out := buf.String()
+	assert.Contains(t, out, "Content-Length: 11\r\n")
+	assert.Contains(t, out, "X-Content-Length: 11\r\n")
+	assert.Contains(t, out, "Connection: keep-alive\r\n")
+	assert.NotContains(t, out, "Transfer-Encoding")
+	assert.NotContains(t, out, "Trailer:")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nhello world")))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Finish sends the body when the handler stops after the last chunk
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetPeerVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\nabc")))
+
+	// Test: a chunked body longer than the buffer is sent unframed, without
+	// its trailers, and the connection is closed after it
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetPeerVersion("1.0")
+	w.SetBufferSize(8)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Content-Length")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world", buf.String())
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello world", buf.String())
+	assert.Equal(t, int64(11), w.Written())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterSetCookie(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "a", Value: "1", Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}))
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	require.Error(t, w.SetCookie(&cookie.Cookie{Name: "c", Value: "x\r\nInjected: 1"}))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+
+	out := buf.String()
+	assert.Contains(t, out, "Set-Cookie: a=1; Expires=Wed, 02 Jan 2030 03:04:05 GMT\r\n")
+	assert.Contains(t, out, "Set-Cookie: b=2; HttpOnly\r\n")
+	assert.NotContains(t, out, "Injected")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	require.Error(t, w.SetCookie(&cookie.Cookie{Name: "late", Value: "1"}))
+}
+
+func TestWriterHeaderCase(t *testing.T) {
+	// Test: names are canonicalized by default
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("content-length", "0")
+	h.Set("x-content-SHA256", "abc")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nX-Content-SHA256: abc\r\n\r\n", buf.String())
+
+	// Test: declared trailer names match the trailer fields sent
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("transfer-encoding", "chunked")
+	h.Set("trailer", "x-content-sha256, X-Content-Length")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("x-content-sha256", "abc")
+	trailers.Set("X-Content-Length", "0")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Content-Sha256, X-Content-Length\r\n\r\n"+
+		"0\r\nX-Content-Sha256: abc\r\nX-Content-Length: 0\r\n\r\n", buf.String())
+
+	// Test: casing is kept when asked
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetPreserveHeaderCase(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("content-length", "0")
+	h.Set("X-Content-SHA256", "abc")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 0\r\nX-Content-SHA256: abc\r\n\r\n", buf.String())
+}
+
+func TestWriterInvalidHeaders(t *testing.T) {
+	// Test: a rejected header section fails the rest of the response
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := GetDefaultHeaders(5)
+	h.Set("X-Name", "a\r\nSet-Cookie: evil=1")
+	require.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidValue)
+	_, err := w.Write([]byte("hello"))
+	require.ErrorIs(t, err, headers.ErrInvalidValue)
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+	require.Error(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: headers held back until the framing is known are checked right
+	// away too
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("X-Name", "a\r\nSet-Cookie: evil=1")
+	require.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidValue)
+	_, err = w.Write([]byte("hello"))
+	require.Error(t, err)
+	require.Error(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: a Content-Length that isn't a length fails before the body can
+	// go out unframed
+	for _, cl := range []string{"five", "-1"} {
+		buf.Reset()
+		w = NewWriter(buf)
+		w.SetKeepAlive(true)
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		h = headers.NewHeaders()
+		h.Set("Content-Length", cl)
+		require.Error(t, w.WriteHeaders(h))
+		_, err = w.Write([]byte("hello"))
+		require.Error(t, err)
+		require.Error(t, w.Finish())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+		assert.False(t, w.KeepAlive())
+	}
+}
+
+func TestWriterInformational(t *testing.T) {
+	// Test: interim responses go out ahead of the final one
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteInformational(StatusContinue, nil))
+	hints := headers.NewHeaders()
+	hints.Add("link", "</style.css>; rel=preload; as=style")
+	hints.Add("link", "</app.js>; rel=preload; as=script")
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, hints))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\nLink: </app.js>; rel=preload; as=script\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+
+	// Test: only 1xx codes, and only before the status line
+	require.Error(t, w.WriteInformational(StatusContinue, nil))
+	w = NewWriter(buf)
+	require.Error(t, w.WriteInformational(StatusOK, nil))
+	require.Error(t, w.WriteInformational(101, nil))
+
+	// Test: HTTP/1.0 clients get nothing
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetPeerVersion("1.0")
+	require.NoError(t, w.WriteInformational(StatusContinue, nil))
+	assert.Empty(t, buf.String())
+}
+
+func TestStatusLine(t *testing.T) {
+	// Test: registered codes get their reason phrase
+	line, err := GetStatusLine(StatusNotFound)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 404 Not Found", string(line))
+	line, err = GetStatusLine(StatusPermanentRedirect)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 308 Permanent Redirect", string(line))
+
+	// Test: unregistered codes get an empty reason phrase
+	line, err = GetStatusLine(599)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 599 ", string(line))
+
+	// Test: custom reason phrases
+	line, err = GetStatusLineReason(StatusOK, "Fine By Me")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Fine By Me", string(line))
+	_, err = GetStatusLineReason(StatusOK, "OK\r\nX-Injected: 1")
+	require.Error(t, err)
+	_, err = GetStatusLine(99)
+	require.Error(t, err)
+	_, err = GetStatusLine(600)
+	require.Error(t, err)
+
+	// Test: classes
+	assert.True(t, StatusEarlyHints.IsInformational())
+	assert.True(t, StatusNoContent.IsSuccess())
+	assert.True(t, StatusSeeOther.IsRedirect())
+	assert.True(t, StatusTooManyRequests.IsClientError())
+	assert.True(t, StatusBadGateway.IsServerError())
+	assert.False(t, StatusNotFound.IsRedirect())
+	assert.False(t, StatusNoContent.AllowsBody())
+	assert.False(t, StatusNotModified.AllowsBody())
+	assert.True(t, StatusOK.AllowsBody())
+}
+
+func TestWriterNoBody(t *testing.T) {
+	// Test: 204 drops the framing headers and refuses a body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: 304 keeps Content-Length but sends no body, even when chunked
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: an empty header section still ends with an empty line
+	for _, code := range []StatusCode{StatusNoContent, StatusNotModified} {
+		buf.Reset()
+		w = NewWriter(buf)
+		w.SetKeepAlive(true)
+		require.NoError(t, w.WriteStatusLine(code))
+		require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+		require.NoError(t, w.Finish())
+		line, err := GetStatusLine(code)
+		require.NoError(t, err)
+		assert.Equal(t, string(line)+"\r\n\r\n", buf.String())
+		assert.True(t, w.KeepAlive())
+	}
+
+	// Test: interim codes can't be the final status
+	w = NewWriter(buf)
+	require.Error(t, w.WriteStatusLine(StatusContinue))
+}
+
+func TestWriterAutoFraming(t *testing.T) {
+	// Test: a small body gets a Content-Length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.Write([]byte("<p>hi"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("</p>"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 9\r\n\r\n<p>hi</p>", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Write on its own sends 200 OK
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", buf.String())
+
+	// Test: nothing written after the status line is an empty body
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: past the buffer size the body switches to chunked
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetBufferSize(8)
+	_, err = w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Flush switches to chunked
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	_, err = w.Write([]byte("tick"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntick\r\n", buf.String())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+
+	// Test: HTTP/1.0 clients get an unframed body and the connection closes
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetPeerVersion("1.0")
+	w.SetBufferSize(4)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Write can't run past a declared Content-Length
+	buf.Reset()
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err = w.Write([]byte("abcd"))
+	require.ErrorIs(t, err, ErrContentLengthExceeded)
+
+	// Test: neither can WriteBody
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("helloEXTRA"))
+	require.ErrorIs(t, err, ErrContentLengthExceeded)
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("!"))
+	require.ErrorIs(t, err, ErrContentLengthExceeded)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: a handler that writes nothing gets an empty 200
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", buf.String())
+	assert.Equal(t, StatusOK, w.Status())
+	assert.True(t, w.KeepAlive())
+}
+
+// readerFromBuffer records whether the writer handed it the body through
+// ReadFrom
+type readerFromBuffer struct {
+	bytes.Buffer
+	readFrom int
+}
+
+func (b *readerFromBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.readFrom++
+	return b.Buffer.ReadFrom(r)
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "body")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("skip:file contents")
+	require.NoError(t, err)
+	_, err = f.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+
+	// Test: a file without declared framing gets its remaining size as the
+	// Content-Length and goes through the connection's ReadFrom
+	buf := &readerFromBuffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	n, err := io.Copy(w, f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nfile contents", buf.String())
+	assert.Equal(t, 1, buf.readFrom)
+	assert.True(t, w.KeepAlive())
+
+	// Test: chunked bodies are copied through Write
+	buf = &readerFromBuffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.Copy(w, strings.NewReader("streamed"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\nstreamed\r\n0\r\n\r\n", buf.String())
+	assert.Equal(t, 0, buf.readFrom)
+
+	// Test: ReadFrom stops at the declared Content-Length
+	buf = &readerFromBuffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	n, err = w.ReadFrom(strings.NewReader("abcdefgh"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nabcd"))
+
+	// Test: WriteString
+	buf = &readerFromBuffer{}
+	w = NewWriter(buf)
+	_, err = io.WriteString(w, "hi")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nhi", buf.String())
+}
+
+func TestWriterTrailers(t *testing.T) {
+	chunked := func() *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		return h
+	}
+
+	// Test: declared trailers are announced and sent after the last chunk
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.DeclareTrailer("X-Checksum"))
+	h := chunked()
+	h.Add("Trailer", "X-Length")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "123")
+	trailers.Set("X-Length", "3")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum, X-Length\r\n\r\n"+
+		"3\r\nabc\r\n0\r\nX-Checksum: 123\r\nX-Length: 3\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: an empty trailer section still ends the message
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\n\r\n"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Finish ends a message the handler left after the last chunk
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\n\r\n"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: undeclared and forbidden trailers are rejected
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.ErrorIs(t, w.DeclareTrailer("Content-Length"), ErrForbiddenTrailer)
+	h = chunked()
+	h.Set("Trailer", "set-cookie")
+	require.ErrorIs(t, w.WriteHeaders(h), ErrForbiddenTrailer)
+	require.ErrorIs(t, w.WriteHeaders(chunked()), ErrForbiddenTrailer)
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Surprise", "1")
+	require.ErrorIs(t, w.WriteTrailers(trailers), ErrUndeclaredTrailer)
+}
+
+func TestWriterHead(t *testing.T) {
+	// Test: HEAD gets the Content-Length GET would have had, without a body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetRequestMethod("HEAD")
+	_, err := w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "world")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: a declared Content-Length is kept and nothing follows it
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: chunked responses send no chunks or trailers
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("data"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterDateAndServer(t *testing.T) {
+	// Test: Date and Server are added unless the handler set them
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetSendDate(true)
+	w.SetServerName("test/1.0")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	out := buf.String()
+	assert.Contains(t, out, "\r\nServer: test/1.0\r\n")
+	assert.Regexp(t, `\r\nDate: [A-Z][a-z]{2}, \d{2} [A-Z][a-z]{2} \d{4} \d{2}:\d{2}:\d{2} GMT\r\n`, out)
+
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetSendDate(true)
+	w.SetServerName("test/1.0")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := GetDefaultHeaders(0)
+	h.Set("Server", "mine")
+	h.Set("Date", "Sun, 06 Nov 1994 08:49:37 GMT")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Contains(t, buf.String(), "\r\nServer: mine\r\n")
+	assert.Contains(t, buf.String(), "\r\nDate: Sun, 06 Nov 1994 08:49:37 GMT\r\n")
+
+	// Test: the cached Date parses back to about now
+	d, err := time.Parse(headers.TimeFormat, Date())
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), d, 2*time.Second)
+}
+
+func TestWriterWritten(t *testing.T) {
+	// Test: buffered bodies are counted once, also after switching to chunked
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetBufferSize(8)
+	assert.Nil(t, w.Headers())
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), w.Written())
+	_, err = w.Write([]byte(" world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, int64(11), w.Written())
+	assert.Equal(t, StatusOK, w.Status())
+	te, _ := w.Headers().Get("Transfer-Encoding")
+	assert.Equal(t, "chunked", te)
+
+	// Test: chunked and copied bodies
+	buf.Reset()
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusCreated))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("X-Test", "1")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = io.Copy(w, strings.NewReader("defg"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, int64(7), w.Written())
+	x, _ := w.Headers().Get("X-Test")
+	assert.Equal(t, "1", x)
+
+	// Test: HEAD bodies are counted though they aren't sent
+	buf.Reset()
+	w = NewWriter(buf)
+	w.SetRequestMethod("HEAD")
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, int64(5), w.Written())
+}
@@ -0,0 +1,123 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrForbiddenTrailer  = errors.New("field not allowed in trailers")
+	ErrUndeclaredTrailer = errors.New("trailer field was not declared")
+)
+
+// forbiddenTrailers are fields a recipient needs before the body, so they
+// can't be sent as trailers (RFC 9110 section 6.5.1): framing, routing,
+// request modifiers, authentication, response control data and the fields
+// describing how to process the content
+var forbiddenTrailers = map[string]bool{
+	"transfer-encoding":   true,
+	"content-length":      true,
+	"trailer":             true,
+	"host":                true,
+	"connection":          true,
+	"keep-alive":          true,
+	"te":                  true,
+	"upgrade":             true,
+	"cache-control":       true,
+	"expect":              true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"range":               true,
+	"if-match":            true,
+	"if-none-match":       true,
+	"if-modified-since":   true,
+	"if-unmodified-since": true,
+	"if-range":            true,
+	"authorization":       true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"www-authenticate":    true,
+	"set-cookie":          true,
+	"cookie":              true,
+	"age":                 true,
+	"date":                true,
+	"expires":             true,
+	"location":            true,
+	"retry-after":         true,
+	"vary":                true,
+	"warning":             true,
+	"content-encoding":    true,
+	"content-type":        true,
+	"content-range":       true,
+}
+
+// DeclareTrailer announces fields that will be sent as trailers, through the
+// Trailer header. It must be called before WriteHeaders. A "Trailer" field in
+// the headers passed to WriteHeaders declares them too.
+func (w *Writer) DeclareTrailer(names ...string) error {
+	if w.wState != wStateStatusLine && w.wState != wStateHeaders {
+		return fmt.Errorf("trailers must be declared before the headers are written")
+	}
+	for _, name := range names {
+		if err := checkTrailerName(name); err != nil {
+			return err
+		}
+	}
+	w.trailers = append(w.trailers, names...)
+	return nil
+}
+
+func checkTrailerName(name string) error {
+	if forbiddenTrailers[strings.ToLower(name)] {
+		return fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+	}
+	return nil
+}
+
+// declareTrailers merges the Trailer field in h with the names from
+// DeclareTrailer and writes the result back as one Trailer field
+func (w *Writer) declareTrailers(h *headers.Headers) error {
+	for _, val := range h.Values("Trailer") {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if err := checkTrailerName(name); err != nil {
+				return err
+			}
+			if !w.trailerDeclared(name) {
+				w.trailers = append(w.trailers, name)
+			}
+		}
+	}
+	if len(w.trailers) > 0 {
+		h.Set("Trailer", strings.Join(w.trailers, ", "))
+	}
+	return nil
+}
+
+func (w *Writer) trailerDeclared(name string) bool {
+	for _, t := range w.trailers {
+		if strings.EqualFold(t, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTrailers makes sure every field in h was declared and is allowed
+func (w *Writer) checkTrailers(h *headers.Headers) error {
+	for name := range h.All() {
+		if err := checkTrailerName(name); err != nil {
+			return err
+		}
+		if !w.trailerDeclared(name) {
+			return fmt.Errorf("%w: %s", ErrUndeclaredTrailer, name)
+		}
+	}
+	return nil
+}
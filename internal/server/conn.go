@@ -0,0 +1,525 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+)
+
+// conn serves every request that arrives on one connection. Clients may
+// pipeline requests, so handlers can run concurrently (up to
+// Config.MaxPipelined at a time), but their responses always go back in the
+// order the requests came in.
+type conn struct {
+	srv    *Server
+	rwc    io.ReadWriteCloser
+	reader *request.Reader
+	queue  *responseQueue
+
+	wg       sync.WaitGroup
+	slots    chan struct{}
+	mu       sync.Mutex
+	inFlight int
+	closing  bool
+	// readStart is when the request being read started to arrive, and
+	// readingHeaders is set until its headers are in
+	readStart      time.Time
+	readingHeaders bool
+}
+
+func newConn(s *Server, rwc io.ReadWriteCloser) *conn {
+	reader := request.NewReader(rwc)
+	reader.SetLimits(s.config.Limits)
+	reader.SetLenient(s.config.LenientHeaders)
+	return &conn{
+		srv:    s,
+		rwc:    rwc,
+		reader: reader,
+		queue:  &responseQueue{w: rwc},
+		slots:  make(chan struct{}, max(s.config.MaxPipelined, 1)),
+	}
+}
+
+func (c *conn) serve() {
+	defer c.wg.Wait()
+
+	for served := 0; ; served++ {
+		c.prepareRead(served)
+		if served > 0 {
+			// the idle timeout runs until the next request starts
+			if err := c.reader.Wait(); err != nil {
+				return
+			}
+		}
+		c.startRead()
+		r, err := c.readRequest()
+		c.headersRead()
+		if err != nil {
+			if c.quietError(err) {
+				return
+			}
+			c.srv.setWriteDeadline(c.rwc)
+			slot := c.queue.push()
+			c.writeParseError(slot, err)
+			slot.finish(false)
+			return
+		}
+
+		keepAlive := r.KeepAlive() && !c.srv.closed.Load() &&
+			(c.srv.config.MaxRequestsPerConn <= 0 || served+1 < c.srv.config.MaxRequestsPerConn)
+		bodyDone := c.dispatch(r, keepAlive)
+		if !keepAlive {
+			return
+		}
+		// a streamed body is still on the wire, the next request starts
+		// after it
+		<-bodyDone
+		if c.isClosing() {
+			return
+		}
+	}
+}
+
+// quietError reports whether err ends the connection without a response: the
+// client went away or was idle, or the server is shutting the connection
+func (c *conn) quietError(err error) bool {
+	if errors.Is(err, io.EOF) || c.srv.closed.Load() || c.isClosing() {
+		return true
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, request.ErrRequestTimeout)
+}
+
+// readRequest reads up to the end of the headers. Unless bodies are
+// streamed, dispatch reads the rest, since a client that sent
+// "Expect: 100-continue" needs an answer before it sends the body.
+func (c *conn) readRequest() (*request.Request, error) {
+	return c.reader.ReadStreamingRequest()
+}
+
+// dispatch runs the handler for r in its own goroutine, once there is room
+// for another request in flight. The returned channel is closed once the
+// request body has been consumed from the connection, which for a buffered
+// body is before the handler even starts.
+func (c *conn) dispatch(r *request.Request, keepAlive bool) <-chan struct{} {
+	c.slots <- struct{}{}
+	c.mu.Lock()
+	c.inFlight++
+	c.mu.Unlock()
+
+	c.srv.setWriteDeadline(c.rwc)
+	slot := c.queue.push()
+	writer := response.NewWriter(slot)
+	writer.SetKeepAlive(keepAlive)
+	writer.SetPeerVersion(r.RequestLine.HttpVersion)
+	writer.SetRequestMethod(r.RequestLine.Method)
+	writer.SetSendDate(!c.srv.config.DisableDate)
+	writer.SetServerName(c.srv.config.ServerName)
+
+	if _, ok := r.Headers.Get("Expect"); ok && r.RequestLine.HttpVersion != "1.0" && !r.ExpectsContinue() {
+		c.writeError(slot, response.StatusExpectationFailed, "unsupported expectation")
+		return c.abort(slot)
+	}
+	switch {
+	case c.srv.config.StreamRequestBody && r.ExpectsContinue():
+		// until the handler asks for the body the connection can't be
+		// reused, so a response that refuses it says it will close
+		writer.SetKeepAlive(false)
+		r.BodyReader = &continueBody{ReadCloser: r.BodyReader, w: writer, keepAlive: keepAlive}
+	case !c.srv.config.StreamRequestBody:
+		if r.ExpectsContinue() {
+			writer.WriteInformational(response.StatusContinue, nil)
+		}
+		if err := c.reader.BufferBody(r); err != nil {
+			if !c.quietError(err) {
+				c.writeParseError(slot, err)
+			}
+			return c.abort(slot)
+		}
+	}
+
+	body := &trackedBody{ReadCloser: r.BodyReader, c: c, done: make(chan struct{})}
+	r.BodyReader = body
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if !c.runHandler(writer, r) {
+			body.Close()
+			c.finish(slot, false)
+			return
+		}
+		if err := writer.Finish(); err != nil {
+			log.Printf("Error finishing response: %v", err)
+		}
+		bodyErr := body.Close()
+		c.finish(slot, writer.KeepAlive() && bodyErr == nil)
+	}()
+	if !c.srv.config.StreamRequestBody {
+		// the body was read above, so the next request can be read while
+		// the handler runs
+		return closedChan()
+	}
+	return body.done
+}
+
+// runHandler calls the handler and recovers if it panics. A panic before the
+// response started is answered with a 500, otherwise what was sent is cut
+// off. Either way it returns false and the connection must be closed, since
+// the request body may be half read.
+func (c *conn) runHandler(w *response.Writer, r *request.Request) (ok bool) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		c.srv.reportPanic(r, v)
+		ok = false
+		if w.Status() != 0 {
+			return
+		}
+		w.SetKeepAlive(false)
+		writeErrorPage(w, errInternal)
+		if err := w.Finish(); err != nil {
+			log.Printf("Error finishing response: %v", err)
+		}
+	}()
+	c.srv.handler(w, r)
+	return true
+}
+
+// abort finishes a response written without calling the handler and closes
+// the connection after it
+func (c *conn) abort(slot *queuedResponse) <-chan struct{} {
+	c.finish(slot, false)
+	return closedChan()
+}
+
+func closedChan() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (c *conn) finish(slot *queuedResponse, keepAlive bool) {
+	slot.finish(keepAlive)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	<-c.slots
+	if !keepAlive {
+		// wake the read loop up so it stops taking new requests
+		c.closing = true
+		setReadDeadline(c.rwc, time.Now())
+		return
+	}
+	if c.inFlight == 0 && !c.closing && !c.readingHeaders {
+		c.srv.setIdleDeadline(c.rwc)
+	}
+}
+
+// prepareRead sets the read deadline for the next request. The idle timeout
+// only runs while no response is still being produced.
+func (c *conn) prepareRead(served int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return
+	}
+	if served > 0 && c.inFlight == 0 {
+		c.srv.setIdleDeadline(c.rwc)
+	} else {
+		setReadDeadline(c.rwc, time.Time{})
+	}
+}
+
+// startRead starts the clock on a request that has started to arrive, or is
+// about to
+func (c *conn) startRead() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readStart = time.Now()
+	c.readingHeaders = true
+	if c.closing {
+		return
+	}
+	timeout := c.srv.config.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = c.srv.config.ReadTimeout
+	}
+	setReadDeadline(c.rwc, deadline(c.readStart, timeout))
+}
+
+// headersRead moves the read deadline to the end of ReadTimeout for the body
+func (c *conn) headersRead() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readingHeaders = false
+	if c.closing {
+		return
+	}
+	setReadDeadline(c.rwc, deadline(c.readStart, c.srv.config.ReadTimeout))
+}
+
+func (c *conn) markClosing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+}
+
+func (c *conn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// writeParseError answers a request that couldn't be parsed. The rest of the
+// stream can't be trusted, so the slot must be finished without keep-alive.
+func (c *conn) writeParseError(slot *queuedResponse, err error) {
+	code := response.StatusBadRequest
+	msg := "bad request"
+	var perr *request.ParseError
+	if errors.As(err, &perr) {
+		code = response.StatusCode(perr.StatusCode)
+		msg = perr.Err.Error()
+	}
+	log.Printf("Error parsing request: %v", err)
+	c.writeError(slot, code, msg)
+}
+
+// writeError writes a plain text response that closes the connection into
+// slot
+func (c *conn) writeError(slot *queuedResponse, code response.StatusCode, msg string) {
+	body := msg + "\n"
+	headers := response.GetDefaultHeaders(len(body))
+	headers.Replace("Connection", "close")
+	if !c.srv.config.DisableDate {
+		headers.Set("Date", response.Date())
+	}
+	if c.srv.config.ServerName != "" {
+		headers.Set("Server", c.srv.config.ServerName)
+	}
+	if response.WriteStatusLine(slot, code) != nil {
+		// a status this package doesn't know, fall back to a plain 400
+		response.WriteStatusLine(slot, response.StatusBadRequest)
+	}
+	response.WriteHeaders(slot, headers)
+	slot.Write([]byte(body))
+}
+
+var errBodyNotSent = errors.New("expected body was never asked for")
+
+// continueBody sends 100 Continue the first time the handler reads a body
+// the client is holding back for one. A handler can refuse the body, with
+// 417 or 413 say, by answering without reading it. The body then never
+// arrives, so the connection isn't reused.
+type continueBody struct {
+	io.ReadCloser
+	w    *response.Writer
+	sent bool
+	// keepAlive is restored on the writer once 100 Continue is out
+	keepAlive bool
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	if !b.sent {
+		b.sent = true
+		// this fails if the final status is already out, then it's up to
+		// the client whether the body still comes
+		if b.w.WriteInformational(response.StatusContinue, nil) == nil {
+			b.w.SetKeepAlive(b.keepAlive)
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func (b *continueBody) Close() error {
+	if !b.sent {
+		return errBodyNotSent
+	}
+	return b.ReadCloser.Close()
+}
+
+// trackedBody reports when the handler is finished with the request body,
+// either by reading it to the end or closing it
+type trackedBody struct {
+	io.ReadCloser
+	c    *conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.once.Do(func() { close(b.done) })
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if err != nil {
+			// the rest of the stream can't be trusted
+			b.c.markClosing()
+		}
+		close(b.done)
+	})
+	return err
+}
+
+var errConnClosed = errors.New("connection closed by an earlier response")
+
+// responseQueue orders the responses on a connection. The response at the
+// front writes straight to the connection, the ones behind it are buffered
+// until everything before them is finished. A buffered response holds at
+// most queuedResponseLimit bytes, after that its handler waits for its turn.
+type responseQueue struct {
+	mu     sync.Mutex
+	w      io.Writer
+	front  *queuedResponse
+	back   *queuedResponse
+	closed bool
+}
+
+// queuedResponseLimit is how much of a response waiting behind others is
+// buffered, so clients that pipeline requests without reading the responses
+// can't make the server hold whole files in memory
+const queuedResponseLimit = 64 << 10
+
+type queuedResponse struct {
+	queue *responseQueue
+	next  *queuedResponse
+
+	mu        sync.Mutex
+	ready     *sync.Cond // signalled when the response is activated or dropped
+	buf       bytes.Buffer
+	direct    bool
+	dropped   bool
+	finished  bool
+	keepAlive bool
+}
+
+func (q *responseQueue) push() *queuedResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r := &queuedResponse{queue: q}
+	r.ready = sync.NewCond(&r.mu)
+	if q.closed {
+		r.dropped = true
+		return r
+	}
+	if q.back == nil {
+		q.front = r
+		r.direct = true
+	} else {
+		q.back.next = r
+	}
+	q.back = r
+	return r
+}
+
+// Write sends p if the response is at the front of the queue and buffers it
+// otherwise, waiting for the response's turn once the buffer is full
+func (r *queuedResponse) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for {
+		switch {
+		case r.dropped:
+			return n, errConnClosed
+		case r.direct:
+			m, err := r.queue.w.Write(p)
+			return n + m, err
+		}
+		room := queuedResponseLimit - r.buf.Len()
+		if room <= 0 && len(p) > 0 {
+			r.ready.Wait()
+			continue
+		}
+		m, _ := r.buf.Write(p[:min(room, len(p))])
+		n += m
+		p = p[m:]
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+}
+
+// ReadFrom lets a response at the front of the queue use the connection's
+// own ReadFrom, so files go out with sendfile or splice on a TCP connection
+func (r *queuedResponse) ReadFrom(src io.Reader) (int64, error) {
+	r.mu.Lock()
+	if r.direct {
+		defer r.mu.Unlock()
+		return io.Copy(r.queue.w, src)
+	}
+	r.mu.Unlock()
+	// Write keeps the buffer within its limit. struct{ io.Writer } hides
+	// this method so io.Copy doesn't come back here.
+	return io.Copy(struct{ io.Writer }{r}, src)
+}
+
+// finish marks the response as complete and, if it is at the front, hands
+// the connection to the responses waiting behind it. If keepAlive is false
+// nothing after this response is ever sent.
+func (r *queuedResponse) finish(keepAlive bool) {
+	q := r.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r.finished = true
+	r.keepAlive = keepAlive
+	if !keepAlive {
+		q.closed = true
+	}
+	if r != q.front {
+		return
+	}
+
+	for cur := r; cur.finished; {
+		next := cur.next
+		if !cur.keepAlive {
+			for ; next != nil; next = next.next {
+				next.drop()
+			}
+			q.front, q.back = nil, nil
+			return
+		}
+		q.front = next
+		if next == nil {
+			q.back = nil
+			return
+		}
+		next.activate()
+		cur = next
+	}
+}
+
+func (r *queuedResponse) activate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.buf.WriteTo(r.queue.w); err != nil {
+		r.queue.closed = true
+	}
+	r.direct = true
+	r.ready.Broadcast()
+}
+
+func (r *queuedResponse) drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf.Reset()
+	r.dropped = true
+	r.ready.Broadcast()
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+)
+
+// HandlerError is an error that becomes a response with StatusCode and Msg
+// when an ErrorHandler returns it. Msg is shown to the client.
+type HandlerError struct {
+	StatusCode response.StatusCode
+	Msg        string
+}
+
+// Errorf returns a HandlerError with a formatted message
+func Errorf(code response.StatusCode, format string, args ...any) *HandlerError {
+	return &HandlerError{StatusCode: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%v: %s", e.StatusCode, e.Msg)
+}
+
+// errInternal is sent in place of errors whose details the client shouldn't
+// see
+var errInternal = &HandlerError{
+	StatusCode: response.StatusInternalServerError,
+	Msg:        "Something went wrong on our end.",
+}
+
+// ErrorHandler is a Handler that can fail. Use HandleError to serve it.
+type ErrorHandler func(w *response.Writer, req *request.Request) error
+
+// HandleError turns h into a Handler. A *HandlerError it returns is sent as
+// an error page with its status and message. Any other error is logged and
+// sent as a 500 without its details. Once h has started its response there
+// is no way to replace it, so the error is only logged.
+func HandleError(h ErrorHandler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		err := h(w, req)
+		if err == nil {
+			return
+		}
+		if w.Status() != 0 {
+			log.Printf("%s %s: error after the response started: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+			return
+		}
+		var herr *HandlerError
+		if !errors.As(err, &herr) {
+			log.Printf("%s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+			herr = errInternal
+		}
+		writeErrorPage(w, herr)
+	}
+}
+
+// writeErrorPage answers with a small HTML page for e
+func writeErrorPage(w *response.Writer, e *HandlerError) {
+	code := e.StatusCode
+	if !code.Valid() || code.IsInformational() {
+		code = response.StatusInternalServerError
+	}
+	text := response.StatusText(code)
+	if text == "" {
+		text = "Error"
+	}
+	body := "<html>\n" +
+		"  <head>\n" +
+		fmt.Sprintf("    <title>%v</title>\n", code) +
+		"  </head>\n" +
+		"  <body>\n" +
+		fmt.Sprintf("    <h1>%s</h1>\n", text) +
+		fmt.Sprintf("    <p>%s</p>\n", html.EscapeString(e.Msg)) +
+		"  </body>\n" +
+		"</html>\n"
+
+	if err := w.WriteStatusLine(code); err != nil {
+		log.Printf("Error writing error page: %v", err)
+		return
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	if err := w.WriteHeaders(h); err != nil {
+		log.Printf("Error writing error page: %v", err)
+		return
+	}
+	w.Write([]byte(body))
+}
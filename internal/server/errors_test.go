@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleError(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("/ok", HandleError(func(w *response.Writer, req *request.Request) error {
+		_, err := w.Write([]byte("fine"))
+		return err
+	}))
+	rt.Handle("/teapot", HandleError(func(w *response.Writer, req *request.Request) error {
+		return Errorf(response.StatusConflict, "short & %s", "stout")
+	}))
+	rt.Handle("/wrapped", HandleError(func(w *response.Writer, req *request.Request) error {
+		return errors.Join(errors.New("loading"), &HandlerError{StatusCode: response.StatusNotFound, Msg: "no such thing"})
+	}))
+	rt.Handle("/unknown", HandleError(func(w *response.Writer, req *request.Request) error {
+		return errors.New("database password is hunter2")
+	}))
+	rt.Handle("/late", HandleError(func(w *response.Writer, req *request.Request) error {
+		w.Write([]byte("partial"))
+		return Errorf(response.StatusBadRequest, "too late")
+	}))
+
+	// Test: no error leaves the response alone
+	assert.Equal(t, "fine", body(route(t, rt, "GET", "/ok", "localhost")))
+
+	// Test: a HandlerError sets the status and an escaped message
+	resp := route(t, rt, "GET", "/teapot", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 409 Conflict\r\n"), resp)
+	assert.Contains(t, resp, "\r\nContent-Type: text/html\r\n")
+	assert.Contains(t, body(resp), "<title>409 Conflict</title>")
+	assert.Contains(t, body(resp), "<p>short &amp; stout</p>")
+
+	// Test: wrapped HandlerErrors are found
+	resp = route(t, rt, "GET", "/wrapped", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"), resp)
+	assert.Contains(t, body(resp), "<h1>Not Found</h1>")
+
+	// Test: other errors are a 500 without their details
+	resp = route(t, rt, "GET", "/unknown", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"), resp)
+	assert.NotContains(t, resp, "hunter2")
+
+	// Test: errors after the response started don't write anything more
+	resp = route(t, rt, "GET", "/late", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Equal(t, "partial", body(resp))
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+)
+
+// Middleware wraps a Handler with behaviour that runs around it, such as
+// logging or authentication. Once the inner handler returns, w.Status,
+// w.Headers and w.Written show what it wrote. Fields the writer adds to a
+// held back response, like Content-Length, Date and Server, aren't in
+// w.Headers yet since they are only added when the server finishes it.
+type Middleware func(next Handler) Handler
+
+// Chain combines middleware into one. The first runs outermost, so
+// Chain(a, b)(h) handles a request with a, then b, then h.
+func Chain(mw ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
+
+// Logger logs the method, target, status, body size and duration of every
+// request to l, or the standard logger if l is nil
+func Logger(l *log.Logger) Middleware {
+	if l == nil {
+		l = log.Default()
+	}
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			status := w.Status()
+			if status == 0 {
+				// the server sends 200 for handlers that wrote nothing
+				status = response.StatusOK
+			}
+			l.Printf("%s %s %d %dB %v", req.RequestLine.Method, req.RequestLine.RequestTarget,
+				status, w.Written(), time.Since(start))
+		}
+	}
+}
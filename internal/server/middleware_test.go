@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+// trace is middleware that records when it runs around the handler
+func trace(calls *[]string, name string) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			*calls = append(*calls, name+" before")
+			next(w, req)
+			*calls = append(*calls, name+" after")
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	// Test: the first middleware runs outermost
+	var calls []string
+	h := Chain(trace(&calls, "a"), trace(&calls, "b"))(func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+	})
+	h(nil, nil)
+	assert.Equal(t, []string{"a before", "b before", "handler", "b after", "a after"}, calls)
+
+	// Test: an empty chain is the handler itself
+	calls = nil
+	Chain()(func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+	})(nil, nil)
+	assert.Equal(t, []string{"handler"}, calls)
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var calls []string
+	rt := NewRouter()
+	rt.Use(trace(&calls, "global"))
+	rt.Handle("GET /a", reply("a"), trace(&calls, "route"))
+	rt.Handle("GET /b", reply("b"))
+
+	// Test: global middleware runs before the route's own
+	assert.Equal(t, "a", body(route(t, rt, "GET", "/a", "localhost")))
+	assert.Equal(t, []string{"global before", "route before", "route after", "global after"}, calls)
+
+	// Test: route middleware only runs for its route
+	calls = nil
+	assert.Equal(t, "b", body(route(t, rt, "GET", "/b", "localhost")))
+	assert.Equal(t, []string{"global before", "global after"}, calls)
+
+	// Test: global middleware sees 404s and 405s
+	calls = nil
+	var statuses []response.StatusCode
+	rt.Use(func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			statuses = append(statuses, w.Status())
+		}
+	})
+	route(t, rt, "GET", "/c", "localhost")
+	route(t, rt, "POST", "/a", "localhost")
+	assert.Equal(t, []response.StatusCode{response.StatusNotFound, response.StatusMethodNotAllowed}, statuses)
+}
+
+func TestMiddlewareObserves(t *testing.T) {
+	// Test: status, headers and body size are visible after the handler
+	var status response.StatusCode
+	var written int64
+	var contentType string
+	rt := NewRouter()
+	rt.Use(func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			status, written = w.Status(), w.Written()
+			contentType, _ = w.Headers().Get("Content-Type")
+		}
+	})
+	rt.Handle("/", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusAccepted)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.Write([]byte("hello"))
+	})
+	route(t, rt, "GET", "/", "localhost")
+	assert.Equal(t, response.StatusAccepted, status)
+	assert.Equal(t, int64(5), written)
+	assert.Equal(t, "text/plain", contentType)
+
+	// Test: the fields the writer adds to a held back body aren't there yet
+	fields := -1
+	rt = NewRouter()
+	rt.Use(func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			fields = w.Headers().Len()
+		}
+	})
+	rt.Handle("/", reply("hello"))
+	assert.Contains(t, route(t, rt, "GET", "/", "localhost"), "\r\nContent-Length: 5\r\n")
+	assert.Equal(t, 0, fields)
+
+	// Test: Logger writes a line per request
+	out := &bytes.Buffer{}
+	rt = NewRouter()
+	rt.Use(Logger(log.New(out, "", 0)))
+	rt.Handle("/", reply("hello"))
+	rt.Handle("/empty", func(w *response.Writer, req *request.Request) {})
+	route(t, rt, "GET", "/?x=1", "localhost")
+	route(t, rt, "GET", "/empty", "localhost")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasPrefix(lines[0], "GET /?x=1 200 5B "), lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "GET /empty 200 0B "), lines[1])
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+)
+
+// Router sends each request to the handler registered for its method, host
+// and path. Patterns look like
+//
+//	[METHOD ][HOST]/PATH
+//
+// such as "GET /users/{id}", "example.com/" or "/static/{file...}". A path
+// segment is either literal, a {name} parameter matching one segment, or a
+// final {name...} wildcard matching the rest of the path. Handlers read the
+// values with Request.PathValue.
+//
+// Literal segments win over parameters and parameters over wildcards, in
+// whatever order the routes were added. Routes for the request's host win
+// over routes without a host. A GET route also serves HEAD, and a route
+// without a method serves every method.
+//
+// Requests for a path without any route get a 404. Requests for a path that
+// only has routes for other methods get a 405 with an Allow header.
+//
+// Middleware added with Use runs for every request, including the 404s and
+// 405s, before the middleware given to Handle for the matched route.
+type Router struct {
+	// NotFound handles requests no route matches, instead of the plain 404
+	NotFound Handler
+
+	hosts      map[string]*routeNode
+	any        *routeNode
+	middleware []Middleware
+}
+
+type routeNode struct {
+	literals map[string]*routeNode
+
+	param     *routeNode
+	paramName string
+
+	wildcard     *routeNode
+	wildcardName string
+
+	// handlers are the routes ending at this node by method, "" is any
+	// method
+	handlers map[string]Handler
+}
+
+type pathParam struct {
+	name  string
+	value string
+}
+
+func NewRouter() *Router {
+	return &Router{
+		hosts: map[string]*routeNode{},
+		any:   &routeNode{},
+	}
+}
+
+// Use adds middleware that runs for every request the router serves
+func (rt *Router) Use(mw ...Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+}
+
+// Handle registers h for pattern, wrapped in mw. A malformed pattern, or one
+// that is already registered, is a programming mistake and panics.
+func (rt *Router) Handle(pattern string, h Handler, mw ...Middleware) {
+	if err := rt.handle(pattern, Chain(mw...)(h)); err != nil {
+		panic(fmt.Sprintf("server: route %q: %v", pattern, err))
+	}
+}
+
+func (rt *Router) handle(pattern string, h Handler) error {
+	method, rest := "", pattern
+	if before, after, ok := strings.Cut(pattern, " "); ok {
+		method, rest = before, strings.TrimLeft(after, " ")
+		if !validMethod(method) {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+	i := strings.IndexByte(rest, '/')
+	if i == -1 {
+		return fmt.Errorf("path must start with /")
+	}
+	host, path := strings.ToLower(rest[:i]), rest[i:]
+
+	root := rt.any
+	if host != "" {
+		if rt.hosts[host] == nil {
+			rt.hosts[host] = &routeNode{}
+		}
+		root = rt.hosts[host]
+	}
+
+	n := root
+	segs := splitPath(path)
+	for i, seg := range segs {
+		name, isParam := strings.CutPrefix(seg, "{")
+		if !isParam {
+			if strings.ContainsAny(seg, "{}") {
+				return fmt.Errorf("parameter must be a whole segment: %q", seg)
+			}
+			if n.literals == nil {
+				n.literals = map[string]*routeNode{}
+			}
+			if n.literals[seg] == nil {
+				n.literals[seg] = &routeNode{}
+			}
+			n = n.literals[seg]
+			continue
+		}
+
+		name, ok := strings.CutSuffix(name, "}")
+		if !ok || name == "" || strings.ContainsAny(name, "{}") {
+			return fmt.Errorf("malformed parameter %q", seg)
+		}
+		if name, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(segs)-1 {
+				return fmt.Errorf("wildcard %q must be the last segment", seg)
+			}
+			if n.wildcard != nil && n.wildcardName != name {
+				return fmt.Errorf("wildcard %q conflicts with {%s...}", seg, n.wildcardName)
+			}
+			if n.wildcard == nil {
+				n.wildcard, n.wildcardName = &routeNode{}, name
+			}
+			n = n.wildcard
+			continue
+		}
+		if n.param != nil && n.paramName != name {
+			return fmt.Errorf("parameter %q conflicts with {%s}", seg, n.paramName)
+		}
+		if n.param == nil {
+			n.param, n.paramName = &routeNode{}, name
+		}
+		n = n.param
+	}
+
+	if n.handlers == nil {
+		n.handlers = map[string]Handler{}
+	}
+	if _, ok := n.handlers[method]; ok {
+		return fmt.Errorf("already registered")
+	}
+	n.handlers[method] = h
+	return nil
+}
+
+func validMethod(method string) bool {
+	for i := 0; i < len(method); i++ {
+		if method[i] < 'A' || method[i] > 'Z' {
+			return false
+		}
+	}
+	return method != ""
+}
+
+// splitPath turns "/a/b" into ["a", "b"]. "/" is a single empty segment, so
+// "/a/" and "/a" are different paths.
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// routeMatch collects the result of a lookup
+type routeMatch struct {
+	handler Handler
+	params  []pathParam
+	// pathFound is set if some route matched the path, whatever its method
+	pathFound bool
+	allowed   []string
+}
+
+// lookup walks the tree, trying literal segments before parameters and
+// parameters before wildcards, and stops at the first route that also
+// matches the method
+func (n *routeNode) lookup(segs []string, method string, params []pathParam, m *routeMatch) bool {
+	if len(segs) == 0 {
+		return n.matchMethod(method, params, m)
+	}
+	seg, rest := segs[0], segs[1:]
+	if child := n.literals[unescapePath(seg)]; child != nil && child.lookup(rest, method, params, m) {
+		return true
+	}
+	// the full slice expression makes append copy, so the branches don't
+	// share the params they add
+	params = params[:len(params):len(params)]
+	if n.param != nil && n.param.lookup(rest, method, append(params, pathParam{n.paramName, unescapePath(seg)}), m) {
+		return true
+	}
+	if n.wildcard != nil {
+		tail := unescapePath(strings.Join(segs, "/"))
+		return n.wildcard.matchMethod(method, append(params, pathParam{n.wildcardName, tail}), m)
+	}
+	return false
+}
+
+func (n *routeNode) matchMethod(method string, params []pathParam, m *routeMatch) bool {
+	if len(n.handlers) == 0 {
+		return false
+	}
+	m.pathFound = true
+	h := n.handlers[method]
+	if h == nil && method == "HEAD" {
+		h = n.handlers["GET"]
+	}
+	if h == nil {
+		h = n.handlers[""]
+	}
+	if h == nil {
+		for allowed := range n.handlers {
+			m.allowed = append(m.allowed, allowed)
+			if allowed == "GET" {
+				m.allowed = append(m.allowed, "HEAD")
+			}
+		}
+		return false
+	}
+	m.handler, m.params = h, params
+	return true
+}
+
+func unescapePath(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// Serve routes req to its handler. Pass rt.Serve wherever a Handler is
+// needed.
+func (rt *Router) Serve(w *response.Writer, req *request.Request) {
+	Chain(rt.middleware...)(rt.route)(w, req)
+}
+
+func (rt *Router) route(w *response.Writer, req *request.Request) {
+	var m routeMatch
+	if req.URL != nil && req.URL.RawPath != "" {
+		segs := splitPath(req.URL.RawPath)
+		method := req.RequestLine.Method
+		if n := rt.hosts[req.Host()]; n == nil || !n.lookup(segs, method, nil, &m) {
+			rt.any.lookup(segs, method, nil, &m)
+		}
+	}
+
+	switch {
+	case m.handler != nil:
+		for _, p := range m.params {
+			req.SetPathValue(p.name, p.value)
+		}
+		m.handler(w, req)
+	case m.pathFound:
+		slices.Sort(m.allowed)
+		h := headers.NewHeaders()
+		h.Set("Allow", strings.Join(slices.Compact(m.allowed), ", "))
+		writePlainStatus(w, response.StatusMethodNotAllowed, h)
+	case rt.NotFound != nil:
+		rt.NotFound(w, req)
+	default:
+		writePlainStatus(w, response.StatusNotFound, headers.NewHeaders())
+	}
+}
+
+// writePlainStatus answers with code and its reason phrase as a text body
+func writePlainStatus(w *response.Writer, code response.StatusCode, h *headers.Headers) {
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	h.Set("Content-Type", "text/plain")
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	w.Write([]byte(response.StatusText(code) + "\n"))
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// route sends a request with the given method, target and Host through rt and
+// returns what was written
+func route(t *testing.T, rt *Router, method, target, host string) string {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequestMethod(method)
+	rt.Serve(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+// reply answers with name followed by the given path values
+func reply(name string, params ...string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + req.PathValue(p)
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func body(resp string) string {
+	_, b, _ := strings.Cut(resp, "\r\n\r\n")
+	return b
+}
+
+func TestRouter(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET /", reply("root"))
+	rt.Handle("GET /users/{id}", reply("user", "id"))
+	rt.Handle("DELETE /users/{id}", reply("delete", "id"))
+	rt.Handle("GET /users/me", reply("me"))
+	rt.Handle("/users/{id}/posts/{post}", reply("post", "id", "post"))
+	rt.Handle("GET /static/{file...}", reply("static", "file"))
+	rt.Handle("GET /{rest...}", reply("catchall", "rest"))
+	rt.Handle("GET api.example.com/users/{id}", reply("api", "id"))
+
+	// Test: literal routes
+	assert.Equal(t, "root", body(route(t, rt, "GET", "/", "localhost")))
+	assert.Equal(t, "me", body(route(t, rt, "GET", "/users/me", "localhost")))
+
+	// Test: parameters, decoded
+	assert.Equal(t, "user id=42", body(route(t, rt, "GET", "/users/42", "localhost")))
+	assert.Equal(t, "user id=a/b", body(route(t, rt, "GET", "/users/a%2Fb", "localhost")))
+	assert.Equal(t, "delete id=7", body(route(t, rt, "DELETE", "/users/7", "localhost")))
+	assert.Equal(t, "post id=7 post=9", body(route(t, rt, "PUT", "/users/7/posts/9", "localhost")))
+
+	// Test: wildcards take the rest of the path
+	assert.Equal(t, "static file=css/site.css", body(route(t, rt, "GET", "/static/css/site.css", "localhost")))
+	assert.Equal(t, "static file=", body(route(t, rt, "GET", "/static/", "localhost")))
+	assert.Equal(t, "catchall rest=static", body(route(t, rt, "GET", "/static", "localhost")))
+	assert.Equal(t, "catchall rest=users/7/x", body(route(t, rt, "GET", "/users/7/x", "localhost")))
+
+	// Test: host routes win over routes for any host
+	assert.Equal(t, "api id=1", body(route(t, rt, "GET", "/users/1", "API.example.com:8080")))
+	assert.Equal(t, "api id=1", body(route(t, rt, "GET", "http://api.example.com/users/1", "other")))
+	assert.Equal(t, "root", body(route(t, rt, "GET", "/", "api.example.com")))
+
+	// Test: GET routes serve HEAD
+	resp := route(t, rt, "HEAD", "/users/me", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Empty(t, body(resp))
+
+	// Test: other methods on a known path get a 405 with Allow
+	resp = route(t, rt, "POST", "/users/42", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, resp, "\r\nAllow: DELETE, GET, HEAD\r\n")
+}
+
+func TestRouterNotFound(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET /a", reply("a"))
+
+	// Test: unknown paths get a 404
+	resp := route(t, rt, "GET", "/b", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+	resp = route(t, rt, "GET", "/a/", "localhost")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: a custom NotFound handler
+	rt.NotFound = reply("missing")
+	assert.Equal(t, "missing", body(route(t, rt, "GET", "/b", "localhost")))
+}
+
+func TestRouterBadPatterns(t *testing.T) {
+	rt := NewRouter()
+	rt.Handle("GET /users/{id}", reply("user"))
+	for _, pattern := range []string{
+		"GET /users/{id}",
+		"GET /users/{uid}/x",
+		"users",
+		"get /x",
+		"/files/{path...}/more",
+		"/a{b}",
+		"/{}",
+	} {
+		assert.Panics(t, func() { rt.Handle(pattern, reply("x")) }, pattern)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"sync/atomic"
+	"time"
 
 	"github.com/peter-howell/httpfromtcp/internal/request"
 	"github.com/peter-howell/httpfromtcp/internal/response"
@@ -15,30 +17,131 @@ import (
 type Server struct {
 	listener net.Listener
 	handler Handler
+	config Config
 	closed atomic.Bool
 }
 
-type HandlerError struct {
-	StatusCode response.StatusCode
-	Msg string
+// Config controls how the server treats connections. The zero value turns
+// every limit off.
+type Config struct {
+	// IdleTimeout is how long a kept-alive connection may wait for the next
+	// request before it is closed
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout is how long a client has to send the request line
+	// and headers once the request starts to arrive. If it is zero,
+	// ReadTimeout is used.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send a whole request,
+	// including the body. Requests that run out of time get a 408.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the handler and the client have, from the end
+	// of a request's headers, until its response is written. Pipelined
+	// requests each push the deadline out.
+	WriteTimeout time.Duration
+	// MaxRequestsPerConn is how many requests are served on one connection
+	// before the server asks the client to reconnect
+	MaxRequestsPerConn int
+	// MaxPipelined is how many requests from one connection may be handled
+	// at the same time. Anything below 2 handles them one after another.
+	MaxPipelined int
+	// StreamRequestBody hands requests to the handler as soon as the headers
+	// are parsed, with the body streamed from the connection through
+	// Request.BodyReader instead of buffered into Request.Body.
+	//
+	// It also decides who answers "Expect: 100-continue". Streamed, 100
+	// Continue is only sent once the handler reads the body, so a handler
+	// can refuse it (with 413 or 417, say) before the client sends it.
+	// Buffered, the server sends 100 Continue and reads the whole body
+	// before the handler runs, so handlers can't refuse it early.
+	StreamRequestBody bool
+	// Limits bounds the size of incoming requests
+	Limits request.Limits
+	// LenientHeaders accepts obsolete line folding in request headers instead
+	// of rejecting the request
+	LenientHeaders bool
+	// ServerName is sent in the Server header of every response that doesn't
+	// set its own. No Server header is sent if it is empty.
+	ServerName string
+	// DisableDate stops the server from adding a Date header to responses
+	DisableDate bool
+	// PanicHandler is called with every panic the server recovers from,
+	// after it was logged. req is nil for panics outside of a handler.
+	PanicHandler func(req *request.Request, v any, stack []byte)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		IdleTimeout: 60 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxRequestsPerConn: 100,
+		MaxPipelined: 8,
+		Limits: request.DefaultLimits(),
+		ServerName: "httpfromtcp",
+	}
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
 func (s *Server) handle(conn io.ReadWriteCloser) {
 	defer conn.Close()
+	defer func() {
+		if v := recover(); v != nil {
+			s.reportPanic(nil, v)
+		}
+	}()
+	newConn(s, conn).serve()
+}
+
+// reportPanic logs a recovered panic with the stack of the goroutine that
+// panicked, so it must be called from the deferred function that recovered
+func (s *Server) reportPanic(req *request.Request, v any) {
+	stack := debug.Stack()
+	if req != nil {
+		log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, v, stack)
+	} else {
+		log.Printf("panic serving connection: %v\n%s", v, stack)
+	}
+	if s.config.PanicHandler != nil {
+		s.config.PanicHandler(req, v, stack)
+	}
+}
 
-	headers := response.GetDefaultHeaders(0)
-	r, err := request.RequestFromReader(conn)
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
 
-	if err != nil {
-		response.WriteStatusLine(conn, response.StatusBadRequest)
-		response.WriteHeaders(conn, headers)
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func (s *Server) setIdleDeadline(conn io.ReadWriteCloser) {
+	d, ok := conn.(deadliner)
+	if !ok || s.config.IdleTimeout <= 0 {
 		return
 	}
+	d.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+}
+
+func setReadDeadline(conn io.ReadWriteCloser, t time.Time) {
+	if d, ok := conn.(deadliner); ok {
+		d.SetReadDeadline(t)
+	}
+}
 
-	writer := response.NewWriter(conn)
-	s.handler(writer, r)
+// deadline returns the time timeout after start, or no deadline if timeout
+// isn't positive
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// setWriteDeadline gives the response started now WriteTimeout to be written
+func (s *Server) setWriteDeadline(conn io.ReadWriteCloser) {
+	if d, ok := conn.(writeDeadliner); ok && s.config.WriteTimeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
 }
 
 func (s *Server) listen() {
@@ -56,6 +159,10 @@ func (s *Server) listen() {
 }
 
 func Serve(port uint16, handler Handler) (*Server, error) {
+	return ServeConfig(port, handler, DefaultConfig())
+}
+
+func ServeConfig(port uint16, handler Handler, config Config) (*Server, error) {
 	// Creates a net.Listener and returns a new Server instance. Starts listening for requests inside a goroutine.
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -65,6 +172,7 @@ func Serve(port uint16, handler Handler) (*Server, error) {
 	server := &Server{
 		listener: listener,
 		handler: handler,
+		config: config,
 	} 
 	go server.listen()
 	return server, nil
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peter-howell/httpfromtcp/internal/headers"
+	"github.com/peter-howell/httpfromtcp/internal/request"
+	"github.com/peter-howell/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip serves one connection with h, sends raw on it and returns
+// everything the server wrote until it closed the connection
+func roundTrip(t *testing.T, h Handler, config Config, raw string) string {
+	client, conn := net.Pipe()
+	s := &Server{handler: h, config: config}
+	go s.handle(conn)
+	go func() {
+		client.Write([]byte(raw))
+	}()
+	out, err := io.ReadAll(bufio.NewReader(client))
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestServerPanics(t *testing.T) {
+	var mu sync.Mutex
+	var reported []any
+	config := DefaultConfig()
+	config.PanicHandler = func(req *request.Request, v any, stack []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, v)
+		assert.NotNil(t, req)
+		assert.Contains(t, string(stack), "TestServerPanics")
+	}
+
+	// Test: a panic before anything was written is a 500 and closes the
+	// connection, dropping the response to the pipelined request after it
+	out := roundTrip(t, func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/" {
+			panic("boom")
+		}
+		w.Write([]byte("next"))
+	}, config, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"), out)
+	assert.Contains(t, out, "\r\nConnection: close\r\n")
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 "))
+	assert.Equal(t, []any{"boom"}, reported)
+
+	// Test: a panic after the response started cuts it off
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.Write([]byte("partial"))
+		panic("late")
+	}, config, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "7\r\npartial\r\n"), out)
+	assert.Equal(t, []any{"boom", "late"}, reported)
+}
+
+func TestServerTimeouts(t *testing.T) {
+	hello := func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("hello"))
+	}
+	config := DefaultConfig()
+	config.ReadHeaderTimeout = 50 * time.Millisecond
+	config.ReadTimeout = 100 * time.Millisecond
+
+	// Test: headers that don't arrive in time get a 408
+	client, conn := net.Pipe()
+	go (&Server{handler: hello, config: config}).handle(conn)
+	_, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: loc"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"), string(out))
+
+	// Test: so does a body that doesn't arrive in time
+	client, conn = net.Pipe()
+	go (&Server{handler: hello, config: config}).handle(conn)
+	_, err = client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	out, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"), string(out))
+
+	// Test: a connection that never sends anything is closed quietly
+	client, conn = net.Pipe()
+	go (&Server{handler: hello, config: config}).handle(conn)
+	out, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// Test: an idle kept-alive connection is closed quietly after its
+	// response
+	config.IdleTimeout = 50 * time.Millisecond
+	out2 := roundTrip(t, hello, config, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 200 OK\r\n"), out2)
+	assert.True(t, strings.HasSuffix(out2, "\r\n\r\nhello"), out2)
+
+	// Test: a response the client doesn't read in time is given up on
+	config.WriteTimeout = 50 * time.Millisecond
+	client, conn = net.Pipe()
+	go (&Server{handler: hello, config: config}).handle(conn)
+	_, err = client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	time.Sleep(150 * time.Millisecond)
+	out, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestServerPipelining(t *testing.T) {
+	// Test: handlers run at the same time and finish out of order, but the
+	// responses come back in request order
+	var running, peak atomic.Int32
+	delays := map[string]time.Duration{"/1": 80, "/2": 60, "/3": 40, "/4": 20}
+	h := func(w *response.Writer, req *request.Request) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(delays[req.URL.Path] * time.Millisecond)
+		running.Add(-1)
+		w.Write([]byte("response " + req.URL.Path))
+	}
+	raw := "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /3 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /4 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	start := time.Now()
+	out := roundTrip(t, h, DefaultConfig(), raw)
+	elapsed := time.Since(start)
+
+	var bodies []string
+	for _, part := range strings.Split(out, "HTTP/1.1 200 OK\r\n")[1:] {
+		bodies = append(bodies, body(part))
+	}
+	assert.Equal(t, []string{"response /1", "response /2", "response /3", "response /4"}, bodies)
+	assert.Greater(t, peak.Load(), int32(1))
+	assert.Less(t, elapsed, 200*time.Millisecond)
+
+	// Test: with MaxPipelined 1 they run one after another
+	peak.Store(0)
+	config := DefaultConfig()
+	config.MaxPipelined = 1
+	out = roundTrip(t, h, config, raw)
+	assert.Equal(t, 4, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, int32(1), peak.Load())
+
+	// Test: a response waiting behind a slow one buffers only so much, then
+	// its handler waits for its turn
+	release := make(chan struct{})
+	wrote := make(chan struct{})
+	big := strings.Repeat("x", 4*queuedResponseLimit)
+	client, conn := net.Pipe()
+	go (&Server{handler: func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+			w.Write([]byte("slow"))
+			return
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(big)))
+		w.Write([]byte(big))
+		close(wrote)
+	}, config: DefaultConfig()}).handle(conn)
+	go client.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /big HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	select {
+	case <-wrote:
+		t.Fatal("the queued response was buffered in full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	r := bufio.NewReader(client)
+	assert.Equal(t, "slow", body(readResponse(t, r)))
+	assert.Equal(t, big, body(readResponse(t, r)))
+	<-wrote
+}
+
+// readResponse reads one response with a Content-Length body off r
+func readResponse(t *testing.T, r *bufio.Reader) string {
+	var head strings.Builder
+	length := 0
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, err = strconv.Atoi(strings.TrimSpace(v))
+			require.NoError(t, err)
+		}
+	}
+	b := make([]byte, length)
+	_, err := io.ReadFull(r, b)
+	require.NoError(t, err)
+	return head.String() + string(b)
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	hello := func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("hello " + req.URL.Path))
+	}
+	get := func(path string) string {
+		return "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	}
+
+	// Test: requests sent one after another share the connection, which is
+	// closed once it has been idle for IdleTimeout
+	config := DefaultConfig()
+	config.IdleTimeout = 50 * time.Millisecond
+	client, conn := net.Pipe()
+	go (&Server{handler: hello, config: config}).handle(conn)
+	r := bufio.NewReader(client)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		_, err := client.Write([]byte(get(path)))
+		require.NoError(t, err)
+		resp := readResponse(t, r)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+		assert.NotContains(t, resp, "Connection: close")
+		assert.Equal(t, "hello "+path, body(resp))
+	}
+	start := time.Now()
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// Test: MaxRequestsPerConn closes the connection after the last one
+	config = DefaultConfig()
+	config.MaxRequestsPerConn = 2
+	out := roundTrip(t, hello, config, get("/a")+get("/b")+get("/c"))
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "\r\nConnection: close\r\n"))
+	assert.True(t, strings.HasSuffix(out, "hello /b"), out)
+
+	// Test: a handler that sets Connection: close ends the connection
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Del("Content-Length")
+		if req.URL.Path == "/close" {
+			h.Set("Connection", "close")
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.Write([]byte("hello " + req.URL.Path))
+	}, DefaultConfig(), get("/a")+get("/close")+get("/c"))
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "\r\nConnection: close\r\n"))
+	assert.True(t, strings.HasSuffix(out, "hello /close"), out)
+
+	// Test: so does a client that asks for it
+	out = roundTrip(t, hello, DefaultConfig(),
+		"GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"+get("/b"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "\r\nConnection: close\r\n")
+
+	// Test: a handler that writes nothing sends an empty 200 and keeps the
+	// connection open
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) {}, DefaultConfig(),
+		get("/a")+"GET /b HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "\r\nConnection: close\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"), out)
+}
+
+func TestServerInvalidHeaders(t *testing.T) {
+	// Test: a response whose headers were rejected is cut off after the
+	// status line and nothing follows it on the connection
+	out := roundTrip(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(5)
+		if req.URL.Path == "/bad" {
+			h.Set("X-Name", "a\r\nSet-Cookie: evil=1")
+		}
+		w.WriteStatusLine(response.StatusOK)
+		err := w.WriteHeaders(h)
+		assert.Equal(t, req.URL.Path == "/bad", err != nil, err)
+		w.Write([]byte("hello"))
+	}, DefaultConfig(), "GET /bad HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /good HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", out)
+}
+
+func TestServerNoContent(t *testing.T) {
+	// Test: bodiless responses without Date or Server headers keep the
+	// connection in sync
+	config := DefaultConfig()
+	config.DisableDate = true
+	config.ServerName = ""
+	out := roundTrip(t, func(w *response.Writer, req *request.Request) {
+		code := response.StatusNoContent
+		if req.URL.Path == "/cached" {
+			code = response.StatusNotModified
+		}
+		w.WriteStatusLine(code)
+		w.WriteHeaders(headers.NewHeaders())
+	}, config, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /cached HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n"+
+		"HTTP/1.1 304 Not Modified\r\n\r\n"+
+		"HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n", out)
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	head := "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"
+	echo := func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/small" {
+			w.WriteStatusLine(response.StatusContentTooLarge)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			return
+		}
+		b, err := io.ReadAll(req.BodyReader)
+		assert.NoError(t, err)
+		w.Write(b)
+	}
+	streaming := DefaultConfig()
+	streaming.StreamRequestBody = true
+
+	// Test: streamed, 100 Continue is sent once the handler reads the body
+	// and the connection stays open
+	client, conn := net.Pipe()
+	go (&Server{handler: echo, config: streaming}).handle(conn)
+	r := bufio.NewReader(client)
+	_, err := client.Write([]byte(head))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readResponse(t, r))
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	resp := readResponse(t, r)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.NotContains(t, resp, "Connection: close")
+	assert.Equal(t, "hello", body(resp))
+	client.Close()
+
+	// Test: streamed, a handler that refuses the body answers without 100
+	// Continue and says the connection closes
+	out := roundTrip(t, echo, streaming, strings.Replace(head, "POST /", "POST /small", 1))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"), out)
+	assert.Contains(t, out, "\r\nConnection: close\r\n")
+	assert.NotContains(t, out, "100 Continue")
+
+	// Test: buffered, the server sends 100 Continue before the handler runs
+	client, conn = net.Pipe()
+	go (&Server{handler: echo, config: DefaultConfig()}).handle(conn)
+	r = bufio.NewReader(client)
+	_, err = client.Write([]byte(strings.Replace(head, "POST /", "POST /small", 1)))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readResponse(t, r))
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 413 "), resp)
+	client.Close()
+}